@@ -0,0 +1,258 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit cross-checks the balances in an etherslurp map against the chain.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"math/rand"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/golang/glog"
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/chain"
+	"github.com/google/trillian-examples/etherslurp/mapper"
+	"github.com/google/trillian-examples/etherslurp/source"
+	"github.com/google/trillian/merkle"
+	"github.com/google/trillian/merkle/maphasher"
+	"github.com/google/trillian/types"
+)
+
+// BalanceOracle knows the true balances of accounts. An ethclient connected to an
+// archive node is one.
+type BalanceOracle interface {
+	// BalanceAt returns the balance of account as of the given block.
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+}
+
+// Mismatch is an account whose balance in the map differs from that on the chain.
+type Mismatch struct {
+	Revision int64
+	Block    int64
+	Address  common.Address
+	Map      *big.Int
+	Chain    *big.Int
+}
+
+// Auditor samples accounts touched by mapped blocks, and compares their balances in
+// the map with those given by a BalanceOracle.
+type Auditor struct {
+	tmap    trillian.TrillianMapClient
+	mapID   int64
+	network *chain.Network
+	src     source.BlockSource
+	oracle  BalanceOracle
+	samples int
+	rand    *rand.Rand
+}
+
+// New creates an Auditor which checks up to samples accounts touched by each block
+// mapped into a revision of the map mapID.
+func New(tmap trillian.TrillianMapClient, mapID int64, network *chain.Network, src source.BlockSource, oracle BalanceOracle, samples int) *Auditor {
+	return &Auditor{
+		tmap:    tmap,
+		mapID:   mapID,
+		network: network,
+		src:     src,
+		oracle:  oracle,
+		samples: samples,
+		rand:    rand.New(rand.NewSource(1)),
+	}
+}
+
+// accounts returns the accounts whose balances are changed by b, including the
+// contracts it creates.
+func (a *Auditor) accounts(b *types.Block) ([]common.Address, error) {
+	seen := make(map[common.Address]bool)
+	var accounts []common.Address
+	add := func(addr common.Address) {
+		if !seen[addr] {
+			seen[addr] = true
+			accounts = append(accounts, addr)
+		}
+	}
+
+	add(b.Coinbase())
+	for _, u := range b.Uncles() {
+		add(u.Coinbase)
+	}
+	signer := types.MakeSigner(a.network.Config, b.Number())
+	for i, tx := range b.Transactions() {
+		from, err := types.Sender(signer, tx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to derive sender on tx@%d@%v", i, b.Number())
+		}
+		add(from)
+		if tx.To() != nil {
+			add(*tx.To())
+		} else {
+			add(crypto.CreateAddress(from, tx.Nonce()))
+		}
+	}
+	return accounts, nil
+}
+
+// sample picks up to n of accounts at random.
+func (a *Auditor) sample(accounts []common.Address, n int) []common.Address {
+	a.rand.Shuffle(len(accounts), func(i, j int) { accounts[i], accounts[j] = accounts[j], accounts[i] })
+	if len(accounts) > n {
+		accounts = accounts[:n]
+	}
+	return accounts
+}
+
+// revision returns the root of revision rev of the map, and the metadata the Mapper
+// wrote with it, which is nil if there is none.
+func (a *Auditor) revision(ctx context.Context, rev int64) (*types.MapRootV1, *mapper.RevisionMetadata, error) {
+	rsp, err := a.tmap.GetSignedMapRootByRevision(ctx, &trillian.GetSignedMapRootByRevisionRequest{MapId: a.mapID, Revision: rev})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get map root at revision %d: %v", rev, err)
+	}
+	var root types.MapRootV1
+	if err := root.UnmarshalBinary(rsp.MapRoot.MapRoot); err != nil {
+		return nil, nil, err
+	}
+	if len(root.Metadata) == 0 {
+		return &root, nil, nil
+	}
+	var meta mapper.RevisionMetadata
+	if err := json.Unmarshal(root.Metadata, &meta); err != nil {
+		return nil, nil, fmt.Errorf("bad metadata at revision %d: %v", rev, err)
+	}
+	return &root, &meta, nil
+}
+
+// AuditRevision checks a sample of the accounts touched by each block mapped into
+// revision rev of the map, i.e. those after the last block in the revision before. It
+// returns the accounts whose balances are wrong.
+func (a *Auditor) AuditRevision(ctx context.Context, rev int64) ([]Mismatch, error) {
+	root, meta, err := a.revision(ctx, rev)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		glog.V(1).Infof("Revision %d has no metadata, skipping", rev)
+		return nil, nil
+	}
+	// Nothing was mapped before the first revision with metadata.
+	first := int64(0)
+	if rev > 0 {
+		_, prev, err := a.revision(ctx, rev-1)
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil {
+			first = prev.Block + 1
+		}
+	}
+
+	seen := make(map[common.Address]bool)
+	var accounts []common.Address
+	for n := first; n <= meta.Block; n++ {
+		b, err := a.src.BlockByNumber(ctx, big.NewInt(n))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get block %d: %v", n, err)
+		}
+		touched, err := a.accounts(b)
+		if err != nil {
+			return nil, err
+		}
+		// An account already picked from an earlier block doesn't use up this
+		// block's samples.
+		var unseen []common.Address
+		for _, addr := range touched {
+			if !seen[addr] {
+				unseen = append(unseen, addr)
+			}
+		}
+		for _, addr := range a.sample(unseen, a.samples) {
+			seen[addr] = true
+			accounts = append(accounts, addr)
+		}
+	}
+	if len(accounts) == 0 {
+		return nil, nil
+	}
+
+	req := &trillian.GetMapLeavesByRevisionRequest{MapId: a.mapID, Revision: rev}
+	for _, addr := range accounts {
+		req.Index = append(req.Index, []byte(mapper.Index(addr.Bytes())))
+	}
+	get, err := a.tmap.GetLeavesByRevision(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balances at revision %d: %v", rev, err)
+	}
+	if got, want := len(get.MapLeafInclusion), len(accounts); got != want {
+		return nil, fmt.Errorf("got %d leaves, expected %d", got, want)
+	}
+	leaves := make(map[string]*trillian.MapLeafInclusion)
+	for _, inc := range get.MapLeafInclusion {
+		leaves[string(inc.Leaf.Index)] = inc
+	}
+
+	num := big.NewInt(meta.Block)
+	var mismatches []Mismatch
+	for _, addr := range accounts {
+		inc, ok := leaves[mapper.Index(addr.Bytes())]
+		if !ok {
+			return nil, fmt.Errorf("no leaf for %x at revision %d", addr, rev)
+		}
+		if err := merkle.VerifyMapInclusionProof(a.mapID, inc.Leaf.Index, inc.Leaf.LeafValue, root.RootHash, inc.Inclusion, maphasher.Default); err != nil {
+			return nil, fmt.Errorf("bad inclusion proof for %x at revision %d: %v", addr, rev, err)
+		}
+		bal := big.NewInt(0)
+		if len(inc.Leaf.LeafValue) > 0 {
+			var ok bool
+			if bal, ok = bal.SetString(string(inc.Leaf.LeafValue), 10); !ok {
+				return nil, fmt.Errorf("leaf value for %x (%s) is corrupt", addr, inc.Leaf.LeafValue)
+			}
+		}
+		want, err := a.oracle.BalanceAt(ctx, addr, num)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get balance of %x at block %d: %v", addr, meta.Block, err)
+		}
+		if bal.Cmp(want) != 0 {
+			mismatches = append(mismatches, Mismatch{Revision: rev, Block: meta.Block, Address: addr, Map: bal, Chain: want})
+		}
+	}
+	glog.Infof("Revision %d (blocks %d to %d): checked %d accounts, %d mismatched", rev, first, meta.Block, len(accounts), len(mismatches))
+	return mismatches, nil
+}
+
+// Audit checks revisions from to to of the map, writing each mismatch found to w as a
+// line of JSON. It returns the number of mismatches.
+func (a *Auditor) Audit(ctx context.Context, from, to int64, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	n := 0
+	for rev := from; rev <= to; rev++ {
+		mismatches, err := a.AuditRevision(ctx, rev)
+		if err != nil {
+			return n, err
+		}
+		for _, m := range mismatches {
+			if err := enc.Encode(m); err != nil {
+				return n, err
+			}
+		}
+		n += len(mismatches)
+	}
+	return n, nil
+}
@@ -0,0 +1,352 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/chain"
+	"github.com/google/trillian-examples/etherslurp/mapper"
+	"github.com/google/trillian-examples/etherslurp/source"
+	"github.com/google/trillian-examples/etherslurp/testonly"
+	"github.com/google/trillian/merkle/maphasher"
+	ttypes "github.com/google/trillian/types"
+	"google.golang.org/grpc"
+)
+
+const testMapID = 7
+
+// bit returns bit b of index, counting from the right.
+func bit(index []byte, b int) int {
+	return int(index[len(index)-1-b/8]>>uint(b%8)) & 1
+}
+
+// subtreeHash returns the hash of the subtree of the given height holding leaves, which
+// are leaf hashes by index.
+func subtreeHash(height int, leaves map[string][]byte) []byte {
+	h := maphasher.Default
+	if len(leaves) == 0 {
+		return h.HashEmpty(testMapID, nil, height)
+	}
+	if height == 0 {
+		for _, lh := range leaves {
+			return lh
+		}
+	}
+	left := make(map[string][]byte)
+	right := make(map[string][]byte)
+	for i, lh := range leaves {
+		if bit([]byte(i), height-1) == 0 {
+			left[i] = lh
+		} else {
+			right[i] = lh
+		}
+	}
+	return h.HashChildren(subtreeHash(height-1, left), subtreeHash(height-1, right))
+}
+
+// fakeRevision is a revision of fakeMap.
+type fakeRevision struct {
+	values   map[string][]byte
+	metadata []byte
+}
+
+// fakeMap is an in-memory sparse Merkle map which serves its revisions with inclusion
+// proofs.
+type fakeMap struct {
+	trillian.TrillianMapClient
+	revisions []fakeRevision
+}
+
+func (m *fakeMap) leafHashes(rev int64) map[string][]byte {
+	hashes := make(map[string][]byte)
+	for i, v := range m.revisions[rev].values {
+		lh, err := maphasher.Default.HashLeaf(testMapID, []byte(i), v)
+		if err != nil {
+			panic(err)
+		}
+		hashes[i] = lh
+	}
+	return hashes
+}
+
+func (m *fakeMap) GetSignedMapRootByRevision(ctx context.Context, req *trillian.GetSignedMapRootByRevisionRequest, opts ...grpc.CallOption) (*trillian.GetSignedMapRootResponse, error) {
+	if req.Revision < 0 || req.Revision >= int64(len(m.revisions)) {
+		return nil, fmt.Errorf("no revision %d", req.Revision)
+	}
+	root, err := (&ttypes.MapRootV1{
+		RootHash: subtreeHash(maphasher.Default.BitLen(), m.leafHashes(req.Revision)),
+		Revision: uint64(req.Revision),
+		Metadata: m.revisions[req.Revision].metadata,
+	}).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &trillian.GetSignedMapRootResponse{MapRoot: &trillian.SignedMapRoot{MapRoot: root}}, nil
+}
+
+func (m *fakeMap) GetLeavesByRevision(ctx context.Context, req *trillian.GetMapLeavesByRevisionRequest, opts ...grpc.CallOption) (*trillian.GetMapLeavesResponse, error) {
+	if req.Revision < 0 || req.Revision >= int64(len(m.revisions)) {
+		return nil, fmt.Errorf("no revision %d", req.Revision)
+	}
+	hashes := m.leafHashes(req.Revision)
+	rsp := &trillian.GetMapLeavesResponse{}
+	for _, index := range req.Index {
+		proof := make([][]byte, maphasher.Default.BitLen())
+		for height := range proof {
+			// The sibling at each height shares the bits above it with index.
+			sibling := make(map[string][]byte)
+			for i, lh := range hashes {
+				same := true
+				for b := height + 1; b < len(proof) && same; b++ {
+					same = bit([]byte(i), b) == bit(index, b)
+				}
+				if same && bit([]byte(i), height) != bit(index, height) {
+					sibling[i] = lh
+				}
+			}
+			if len(sibling) > 0 {
+				proof[height] = subtreeHash(height, sibling)
+			}
+		}
+		rsp.MapLeafInclusion = append(rsp.MapLeafInclusion, &trillian.MapLeafInclusion{
+			Leaf:      &trillian.MapLeaf{Index: index, LeafValue: m.revisions[req.Revision].values[string(index)]},
+			Inclusion: proof,
+		})
+	}
+	return rsp, nil
+}
+
+// fakeOracle knows the balance of each account at one block.
+type fakeOracle struct {
+	block    int64
+	balances map[common.Address]*big.Int
+}
+
+func (o *fakeOracle) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	if blockNumber.Int64() != o.block {
+		return nil, fmt.Errorf("asked for balance at block %v, only know block %d", blockNumber, o.block)
+	}
+	if b, ok := o.balances[account]; ok {
+		return b, nil
+	}
+	return big.NewInt(0), nil
+}
+
+// multiOracle dispatches to the fakeOracle for each block.
+type multiOracle map[int64]*fakeOracle
+
+func (m multiOracle) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	o, ok := m[blockNumber.Int64()]
+	if !ok {
+		return nil, fmt.Errorf("no balances at block %v", blockNumber)
+	}
+	return o.BalanceAt(ctx, account, blockNumber)
+}
+
+// testBlocks returns consecutive blocks from genesis, mined by the given accounts.
+func testBlocks(miners []common.Address) []*types.Block {
+	return testonly.Chain(0, len(miners), func(h *types.Header) { h.Coinbase = miners[h.Number.Int64()] })
+}
+
+func metadata(t *testing.T, block int64) []byte {
+	t.Helper()
+	j, err := json.Marshal(mapper.RevisionMetadata{Block: block})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestAudit(t *testing.T) {
+	var miners []common.Address
+	for i := 1; i <= 6; i++ {
+		miners = append(miners, common.BigToAddress(big.NewInt(int64(i))))
+	}
+	src, err := source.NewBlocks(testBlocks(miners))
+	if err != nil {
+		t.Fatal(err)
+	}
+	balances := func(bals map[int]int64) map[string][]byte {
+		values := make(map[string][]byte)
+		for m, b := range bals {
+			values[mapper.Index(miners[m].Bytes())] = []byte(big.NewInt(b).String())
+		}
+		return values
+	}
+	chainBalances := func(bals map[int]int64) map[common.Address]*big.Int {
+		r := make(map[common.Address]*big.Int)
+		for m, b := range bals {
+			r[miners[m]] = big.NewInt(b)
+		}
+		return r
+	}
+
+	// Revision 1 maps blocks 0 to 3, and revision 2 blocks 4 and 5. The map has the
+	// wrong balance for the miner of block 4.
+	tmap := &fakeMap{revisions: []fakeRevision{
+		{},
+		{values: balances(map[int]int64{0: 5, 1: 5, 2: 5, 3: 5}), metadata: metadata(t, 3)},
+		{values: balances(map[int]int64{0: 5, 1: 5, 2: 5, 3: 5, 4: 4, 5: 5}), metadata: metadata(t, 5)},
+	}}
+	oracle := multiOracle{
+		3: {block: 3, balances: chainBalances(map[int]int64{0: 5, 1: 5, 2: 5, 3: 5})},
+		5: {block: 5, balances: chainBalances(map[int]int64{0: 5, 1: 5, 2: 5, 3: 5, 4: 5, 5: 5})},
+	}
+
+	a := New(tmap, testMapID, chain.Networks["mainnet"], src, oracle, 10)
+	var out bytes.Buffer
+	n, err := a.Audit(context.Background(), 0, 2, &out)
+	if err != nil {
+		t.Fatalf("Audit(): %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("Audit() found %d mismatches, want 1: %s", n, out.String())
+	}
+	var m Mismatch
+	if err := json.Unmarshal(out.Bytes(), &m); err != nil {
+		t.Fatalf("Failed to parse mismatch %q: %v", out.String(), err)
+	}
+	if m.Revision != 2 || m.Block != 5 || m.Address != miners[4] || m.Map.Int64() != 4 || m.Chain.Int64() != 5 {
+		t.Errorf("Audit() found %+v, want miner of block 4 at revision 2", m)
+	}
+}
+
+func TestAuditRevisionWindow(t *testing.T) {
+	var miners []common.Address
+	for i := 1; i <= 6; i++ {
+		miners = append(miners, common.BigToAddress(big.NewInt(int64(i))))
+	}
+	src, err := source.NewBlocks(testBlocks(miners))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every account is wrong in the map, so each one sampled is a mismatch.
+	tmap := &fakeMap{revisions: []fakeRevision{
+		{},
+		{metadata: metadata(t, 1)},
+		{metadata: metadata(t, 5)},
+	}}
+	bals := make(map[common.Address]*big.Int)
+	for _, m := range miners {
+		bals[m] = big.NewInt(1)
+	}
+	oracle := &fakeOracle{block: 5, balances: bals}
+
+	for _, tc := range []struct {
+		samples int
+		want    int
+	}{
+		{samples: 10, want: 4},
+		{samples: 1, want: 4},
+	} {
+		a := New(tmap, testMapID, chain.Networks["mainnet"], src, oracle, tc.samples)
+		mismatches, err := a.AuditRevision(context.Background(), 2)
+		if err != nil {
+			t.Fatalf("AuditRevision(): %v", err)
+		}
+		if got := len(mismatches); got != tc.want {
+			t.Errorf("AuditRevision() with %d samples checked %d accounts, want %d", tc.samples, got, tc.want)
+		}
+		for _, m := range mismatches {
+			if m.Address == miners[0] || m.Address == miners[1] {
+				t.Errorf("AuditRevision() checked %x, which was mapped in revision 1", m.Address)
+			}
+		}
+	}
+}
+
+// txBlock returns block 1, mined by miner, in which the holder of key pays two
+// accounts and creates a contract. It also returns the accounts the block touches.
+func txBlock(t *testing.T, miner common.Address) (*types.Block, []common.Address) {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	r1, r2 := common.BigToAddress(big.NewInt(101)), common.BigToAddress(big.NewInt(102))
+	h := testonly.Header(1)
+	h.Coinbase = miner
+	b, err := testonly.Block(chain.Networks["mainnet"].Config, h, key,
+		types.NewTransaction(0, r1, big.NewInt(1), 21000, big.NewInt(1), nil),
+		types.NewTransaction(1, r2, big.NewInt(1), 21000, big.NewInt(1), nil),
+		types.NewContractCreation(2, big.NewInt(1), 100000, big.NewInt(1), []byte{0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, []common.Address{miner, sender, r1, r2, crypto.CreateAddress(sender, 2)}
+}
+
+func TestAccounts(t *testing.T) {
+	b, want := txBlock(t, common.BigToAddress(big.NewInt(1)))
+	a := New(nil, testMapID, chain.Networks["mainnet"], nil, nil, 1)
+	got, err := a.accounts(b)
+	if err != nil {
+		t.Fatalf("accounts(): %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("accounts() = %x, want %x", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("accounts()[%d] = %x, want %x", i, got[i], want[i])
+		}
+	}
+}
+
+func TestAuditSamplesPerBlock(t *testing.T) {
+	genesis := testonly.Chain(0, 1, func(h *types.Header) { h.Coinbase = common.BigToAddress(big.NewInt(1)) })[0]
+	b, touched := txBlock(t, common.BigToAddress(big.NewInt(2)))
+	src, err := source.NewBlocks([]*types.Block{genesis, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every account is wrong in the map, so each one sampled is a mismatch.
+	tmap := &fakeMap{revisions: []fakeRevision{{metadata: metadata(t, 1)}}}
+	bals := map[common.Address]*big.Int{genesis.Coinbase(): big.NewInt(1)}
+	for _, addr := range touched {
+		bals[addr] = big.NewInt(1)
+	}
+	oracle := &fakeOracle{block: 1, balances: bals}
+
+	for _, tc := range []struct {
+		samples int
+		want    int
+	}{
+		// Block 0 touches one account, and block 1 five.
+		{samples: 1, want: 2},
+		{samples: 3, want: 4},
+		{samples: 10, want: 6},
+	} {
+		a := New(tmap, testMapID, chain.Networks["mainnet"], src, oracle, tc.samples)
+		mismatches, err := a.AuditRevision(context.Background(), 0)
+		if err != nil {
+			t.Fatalf("AuditRevision(): %v", err)
+		}
+		if got := len(mismatches); got != tc.want {
+			t.Errorf("AuditRevision() with %d samples checked %d accounts, want %d", tc.samples, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package blockleaf defines the contents of the leaves in the etherslurp Log.
+//
+// The original leaf format is a bare RLP encoded block. Later formats are an RLP list
+// whose first element is a version number, which can't be confused with a bare block
+// since that starts with its header, which is itself a list.
+package blockleaf
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Leaf format versions.
+const (
+	// VersionBlock is a bare RLP encoded block.
+	VersionBlock uint64 = 0
+	// VersionBlockReceipts is a block along with the receipts for its transactions.
+	VersionBlockReceipts uint64 = 1
+	// VersionHeader is just a block header.
+	VersionHeader uint64 = 2
+)
+
+// Leaf is the decoded contents of a log leaf.
+type Leaf struct {
+	Version uint64
+	// Block is nil for VersionHeader leaves, which set Header instead.
+	Block  *types.Block
+	Header *types.Header
+	// Receipts holds the receipts for Block's transactions, in the same order. It's
+	// nil if the leaf doesn't include receipts.
+	Receipts []*types.Receipt
+	// LogIndex is the index of the log leaf l was read from, if the reader sets it.
+	// It isn't part of the encoding.
+	LogIndex int64
+}
+
+// BlockHeader returns the header of the block in l.
+func (l *Leaf) BlockHeader() *types.Header {
+	if l.Block == nil {
+		return l.Header
+	}
+	return l.Block.Header()
+}
+
+type header struct {
+	Version uint64
+	Header  *types.Header
+}
+
+type blockReceipts struct {
+	Version  uint64
+	Block    *types.Block
+	Receipts []*types.ReceiptForStorage
+}
+
+// Encode returns the RLP encoding of l, in the format given by l.Version.
+func Encode(l *Leaf) ([]byte, error) {
+	switch l.Version {
+	case VersionBlock:
+		return rlp.EncodeToBytes(l.Block)
+	case VersionBlockReceipts:
+		if got, want := len(l.Receipts), len(l.Block.Transactions()); got != want {
+			return nil, fmt.Errorf("got %d receipts for %d transactions", got, want)
+		}
+		rs := make([]*types.ReceiptForStorage, len(l.Receipts))
+		for i, r := range l.Receipts {
+			rs[i] = (*types.ReceiptForStorage)(r)
+		}
+		return rlp.EncodeToBytes(&blockReceipts{Version: l.Version, Block: l.Block, Receipts: rs})
+	case VersionHeader:
+		return rlp.EncodeToBytes(&header{Version: l.Version, Header: l.Header})
+	}
+	return nil, fmt.Errorf("unknown leaf version %d", l.Version)
+}
+
+// Decode decodes a log leaf of any version.
+func Decode(b []byte) (*Leaf, error) {
+	content, _, err := rlp.SplitList(b)
+	if err != nil {
+		return nil, err
+	}
+	kind, val, _, err := rlp.Split(content)
+	if err != nil {
+		return nil, err
+	}
+	if kind == rlp.List {
+		block := &types.Block{}
+		if err := rlp.DecodeBytes(b, block); err != nil {
+			return nil, err
+		}
+		return &Leaf{Version: VersionBlock, Block: block}, nil
+	}
+
+	switch v := new(big.Int).SetBytes(val); {
+	case v.IsUint64() && v.Uint64() == VersionBlockReceipts:
+		var br blockReceipts
+		if err := rlp.DecodeBytes(b, &br); err != nil {
+			return nil, err
+		}
+		l := &Leaf{Version: br.Version, Block: br.Block, Receipts: make([]*types.Receipt, len(br.Receipts))}
+		for i, r := range br.Receipts {
+			l.Receipts[i] = (*types.Receipt)(r)
+		}
+		return l, nil
+	case v.IsUint64() && v.Uint64() == VersionHeader:
+		var h header
+		if err := rlp.DecodeBytes(b, &h); err != nil {
+			return nil, err
+		}
+		return &Leaf{Version: h.Version, Header: h.Header}, nil
+	default:
+		return nil, fmt.Errorf("unknown leaf version %s", v)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chain describes the Ethereum networks which etherslurp can follow.
+//
+// A log is tied to a network by its first leaf, which is always the network's genesis
+// block. The chain ID and fork configuration are then those of the network with that
+// genesis hash.
+package chain
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Network identifies an Ethereum network.
+type Network struct {
+	Name    string
+	Config  *params.ChainConfig
+	Genesis common.Hash
+}
+
+// Networks holds the known networks, by name.
+var Networks = map[string]*Network{
+	"mainnet": {Name: "mainnet", Config: params.MainnetChainConfig, Genesis: params.MainnetGenesisHash},
+	"ropsten": {Name: "ropsten", Config: params.TestnetChainConfig, Genesis: params.TestnetGenesisHash},
+	"rinkeby": {Name: "rinkeby", Config: params.RinkebyChainConfig, Genesis: params.RinkebyGenesisHash},
+}
+
+// Lookup returns the network with the given name.
+func Lookup(name string) (*Network, error) {
+	n, ok := Networks[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown network %q", name)
+	}
+	return n, nil
+}
+
+// ChainID returns the network's EIP-155 chain ID.
+func (n *Network) ChainID() *big.Int {
+	return n.Config.ChainId
+}
+
+// CheckChainID returns an error if id isn't the network's chain ID.
+func (n *Network) CheckChainID(id *big.Int) error {
+	if id.Cmp(n.ChainID()) != 0 {
+		return fmt.Errorf("chain ID is %v, but %s has chain ID %v", id, n.Name, n.ChainID())
+	}
+	return nil
+}
+
+// CheckGenesis returns an error if h isn't the header of the network's genesis block.
+func (n *Network) CheckGenesis(h *types.Header) error {
+	if h.Number.Sign() != 0 {
+		return fmt.Errorf("block %v is not a genesis block", h.Number)
+	}
+	if got := h.Hash(); got != n.Genesis {
+		return fmt.Errorf("genesis block has hash %x, but %s has genesis %x", got, n.Name, n.Genesis)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/golang/glog"
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/audit"
+	"github.com/google/trillian-examples/etherslurp/chain"
+	"github.com/google/trillian-examples/etherslurp/source"
+	"github.com/google/trillian/types"
+	"google.golang.org/grpc"
+)
+
+var (
+	geth        = flag.String("geth", "", "URL of the geth RPC server, which must be an archive node.")
+	trillianMap = flag.String("trillian_map", "", "URL of the Trillian Map RPC server.")
+	mapID       = flag.Int64("map_id", 0, "Trillian MapID to audit.")
+	network     = flag.String("network", "mainnet", "Ethereum network the map is for: mainnet, ropsten or rinkeby.")
+	samples     = flag.Int("samples", 10, "Number of accounts to check for each block mapped.")
+	fromRev     = flag.Int64("from_revision", 1, "First map revision to audit.")
+	toRev       = flag.Int64("to_revision", -1, "Last map revision to audit, or -1 for the latest.")
+	report      = flag.String("report", "", "File to write mismatches to, as lines of JSON. Defaults to stdout.")
+)
+
+func main() {
+	flag.Parse()
+	ctx := context.Background()
+
+	if *mapID == 0 {
+		glog.Exitf("MapID is set to zero, I don't believe you! Set --map_id")
+	}
+
+	n, err := chain.Lookup(*network)
+	if err != nil {
+		glog.Exitf("Bad --network: %v", err)
+	}
+
+	gc, err := ethclient.Dial(*geth)
+	if err != nil {
+		glog.Exitf("Failed to dial geth: %v", err)
+	}
+
+	tmc, err := grpc.Dial(*trillianMap, grpc.WithInsecure())
+	if err != nil {
+		glog.Exitf("Failed to dial Trillian Map: %v", err)
+	}
+	tmap := trillian.NewTrillianMapClient(tmc)
+
+	to := *toRev
+	if to < 0 {
+		rsp, err := tmap.GetSignedMapRoot(ctx, &trillian.GetSignedMapRootRequest{MapId: *mapID})
+		if err != nil {
+			glog.Exitf("Failed to get latest map root: %v", err)
+		}
+		var root types.MapRootV1
+		if err := root.UnmarshalBinary(rsp.MapRoot.MapRoot); err != nil {
+			glog.Exitf("Failed to unmarshal map root: %v", err)
+		}
+		to = int64(root.Revision)
+	}
+
+	var w io.Writer = os.Stdout
+	if *report != "" {
+		f, err := os.Create(*report)
+		if err != nil {
+			glog.Exitf("Failed to create report: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	a := audit.New(tmap, *mapID, n, source.NewEthClient(gc), gc, *samples)
+	mismatches, err := a.Audit(ctx, *fromRev, to, w)
+	if err != nil {
+		glog.Exitf("Audit failed: %v", err)
+	}
+	glog.Infof("Audited revisions %d to %d: %d mismatches", *fromRev, to, mismatches)
+}
@@ -16,21 +16,59 @@ package main
 
 import (
 	"context"
+	"crypto"
 	"flag"
+	"net/http"
 
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/golang/glog"
 	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/chain"
 	"github.com/google/trillian-examples/etherslurp/follower"
+	"github.com/google/trillian-examples/etherslurp/source"
+	"github.com/google/trillian/client"
+	"github.com/google/trillian/crypto/keys/pem"
+	"github.com/google/trillian/merkle/rfc6962"
 	"google.golang.org/grpc"
 )
 
 var (
 	geth        = flag.String("geth", "", "URL of the geth RPC server.")
+	blocksFile  = flag.String("blocks_file", "", "File of RLP encoded blocks, as written by 'geth export', to read instead of --geth.")
 	trillianLog = flag.String("trillian_log", "", "URL of the Trillian Log RPC server.")
 	logID       = flag.Int64("log_id", 0, "Trillian LogID to populate.")
+	confirms    = flag.Uint64("confirmations", 12, "Number of blocks which must follow a block before it is logged.")
+	batchSize   = flag.Uint64("batch_size", 100, "Maximum number of blocks to add to the log at once.")
+	workers     = flag.Int("workers", 10, "Number of blocks to fetch from geth concurrently.")
+	logPubKey   = flag.String("log_public_key", "", "PEM file holding the log's public key, used to verify log roots.")
+	stateFile   = flag.String("state_file", "follower.state", "File in which to keep the follower's progress.")
+	endpoint    = flag.String("http_endpoint", "", "Address to serve the follower's status on, e.g. localhost:9002. Not served if empty.")
+	receipts    = flag.Bool("receipts", false, "Log the receipts for each block's transactions along with the block.")
+	headersOnly = flag.Bool("headers_only", false, "Log only block headers, rather than whole blocks.")
+	seal        = flag.String("seal", "none", "Seal to verify on each block: none, ethash or clique.")
+	ethashDir   = flag.String("ethash_dir", "ethash", "Directory in which to keep ethash verification caches.")
+	network     = flag.String("network", "mainnet", "Ethereum network being followed: mainnet, ropsten or rinkeby.")
+	bfWorkers   = flag.Int("backfill_workers", 4, "Number of workers fetching blocks in parallel when catching up with the chain, or 0 to disable.")
+	bfRange     = flag.Uint64("backfill_range", 1000, "Number of consecutive blocks fetched by each backfill worker at a time.")
+	maxPending  = flag.Int("max_pending", 10000, "Maximum number of blocks added to the log but not yet integrated before the follower waits for the log.")
 )
 
+func sealVerifier(n *chain.Network) follower.SealVerifier {
+	switch *seal {
+	case "none":
+		return nil
+	case "ethash":
+		return follower.NewEthashVerifier(*ethashDir)
+	case "clique":
+		if n.Config.Clique == nil {
+			glog.Exitf("Network %s does not use clique", n.Name)
+		}
+		return follower.NewCliqueVerifier(n.Config.Clique)
+	}
+	glog.Exitf("Unknown seal type %q", *seal)
+	return nil
+}
+
 func main() {
 	flag.Parse()
 	ctx := context.Background()
@@ -38,10 +76,24 @@ func main() {
 	if *logID == 0 {
 		glog.Exitf("LogID is set to zero, I don't believe you! Set --log_id")
 	}
-
-	gc, err := ethclient.Dial(*geth)
+	n, err := chain.Lookup(*network)
 	if err != nil {
-		glog.Exitf("Failed to dial geth: %v", err)
+		glog.Exitf("Bad --network: %v", err)
+	}
+
+	var src source.BlockSource
+	if *blocksFile != "" {
+		fs, err := source.NewFile(*blocksFile)
+		if err != nil {
+			glog.Exitf("Failed to read blocks: %v", err)
+		}
+		src = fs
+	} else {
+		gc, err := ethclient.Dial(*geth)
+		if err != nil {
+			glog.Exitf("Failed to dial geth: %v", err)
+		}
+		src = source.NewEthClient(gc)
 	}
 
 	tc, err := grpc.Dial(*trillianLog, grpc.WithInsecure())
@@ -49,6 +101,39 @@ func main() {
 		glog.Exitf("Failed to dial Trillian Log: %v", err)
 	}
 
-	f := follower.New(gc, trillian.NewTrillianLogClient(tc), *logID, follower.Opts{})
-	f.Follow(ctx)
+	opts := follower.Opts{
+		BatchSize:       *batchSize,
+		Workers:         *workers,
+		Confirmations:   *confirms,
+		StateFile:       *stateFile,
+		Receipts:        *receipts,
+		HeadersOnly:     *headersOnly,
+		SealVerifier:    sealVerifier(n),
+		Network:         n,
+		BackfillWorkers: *bfWorkers,
+		BackfillRange:   *bfRange,
+		MaxPending:      *maxPending,
+		OnIntegrityFailure: func(err error) {
+			glog.Errorf("ALERT: %v", err)
+		},
+	}
+	if *logPubKey != "" {
+		pubKey, err := pem.ReadPublicKeyFile(*logPubKey)
+		if err != nil {
+			glog.Exitf("Failed to read log public key: %v", err)
+		}
+		opts.Verifier = client.NewLogVerifier(rfc6962.DefaultHasher, pubKey, crypto.SHA256)
+	} else {
+		glog.Warningf("No --log_public_key given, log roots will not be verified")
+	}
+
+	f := follower.New(src, trillian.NewTrillianLogClient(tc), *logID, opts)
+	if *endpoint != "" {
+		go func() {
+			glog.Info(http.ListenAndServe(*endpoint, f))
+		}()
+	}
+	if err := f.Follow(ctx); err != nil {
+		glog.Exitf("Follower stopped: %v", err)
+	}
 }
@@ -17,10 +17,17 @@ package main
 import (
 	"context"
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/golang/glog"
 	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/chain"
 	"github.com/google/trillian-examples/etherslurp/mapper"
+	"github.com/google/trillian-examples/etherslurp/source"
 	"google.golang.org/grpc"
 )
 
@@ -28,19 +35,59 @@ var (
 	trillianLog = flag.String("trillian_log", "", "URL of the Trillian Log RPC server.")
 	trillianMap = flag.String("trillian_map", "", "URL of the Trillian Map RPC server.")
 	logID       = flag.Int64("log_id", 0, "Trillian LogID to populate.")
-	mapID       = flag.Int64("map_id", 0, "Trillian MapID to populate.")
-	from        = flag.Int64("from", 0, "Block to start at.")
+	mapID       = flag.Int64("map_id", 0, "Trillian MapID to populate with balances, or 0 for none.")
+	nonceMapID  = flag.Int64("nonce_map_id", 0, "Trillian MapID to populate with account nonces, or 0 for none.")
+	txMapID     = flag.Int64("tx_map_id", 0, "Trillian MapID to populate with the location of each transaction, or 0 for none.")
+	countMapID  = flag.Int64("tx_count_map_id", 0, "Trillian MapID to populate with per-account transaction counts, or 0 for none.")
+	from        = flag.Int64("from", -1, "Block to start at, or -1 to resume after the last block in the map.")
+	network     = flag.String("network", "mainnet", "Ethereum network the log is for: mainnet, ropsten or rinkeby.")
+	window      = flag.Int("window", 100, "Number of blocks to write to each map in each revision.")
+	flushEvery  = flag.Duration("flush_interval", 10*time.Second, "How long to wait for more blocks before writing fewer than --window.")
+	onCorrupt   = flag.String("on_corrupt_leaf", "halt", "What to do about a leaf in a map that's corrupt: halt, skip or quarantine.")
+	onDecode    = flag.String("on_decode_error", "halt", "What to do about a block in the log that can't be decoded: halt, skip or quarantine.")
+	genesis     = flag.String("genesis", "", "Genesis file, as given to 'geth init', whose allocation is applied to the map before any blocks.")
+	geth        = flag.String("geth", "", "URL of the geth RPC server, to fetch receipts from if the log doesn't hold them.")
 )
 
+var actions = map[string]mapper.Action{
+	"halt":       mapper.Halt,
+	"skip":       mapper.Skip,
+	"quarantine": mapper.Quarantine,
+}
+
+func action(flagName, v string) mapper.Action {
+	a, ok := actions[v]
+	if !ok {
+		glog.Exitf("Bad --%s %q, want halt, skip or quarantine", flagName, v)
+	}
+	return a
+}
+
 func main() {
 	flag.Parse()
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sigs
+		glog.Infof("Got %v, stopping", s)
+		cancel()
+	}()
 
 	if *logID == 0 {
 		glog.Exitf("LogID is set to zero, I don't believe you! Set --log_id")
 	}
-	if *mapID == 0 {
-		glog.Exitf("MapID is set to zero, I don't believe you! Set --map_id")
+	if *mapID == 0 && *nonceMapID == 0 && *txMapID == 0 && *countMapID == 0 {
+		glog.Exitf("All MapIDs are set to zero, I don't believe you! Set --map_id")
+	}
+	if *genesis != "" && *mapID == 0 {
+		glog.Exitf("--genesis needs a balance map, set --map_id")
+	}
+
+	n, err := chain.Lookup(*network)
+	if err != nil {
+		glog.Exitf("Bad --network: %v", err)
 	}
 
 	tlc, err := grpc.Dial(*trillianLog, grpc.WithInsecure())
@@ -53,6 +100,64 @@ func main() {
 		glog.Exitf("Failed to dial Trillian Map: %v", err)
 	}
 
-	m := mapper.New(trillian.NewTrillianLogClient(tlc), *logID, trillian.NewTrillianMapClient(tmc), *mapID)
-	m.Map(ctx, *from)
+	corruptAction := action("on_corrupt_leaf", *onCorrupt)
+	decodeAction := action("on_decode_error", *onDecode)
+	opts := mapper.Opts{
+		Window:        *window,
+		FlushInterval: *flushEvery,
+		OnError: func(err error) mapper.Action {
+			if _, ok := err.(*mapper.CorruptLeafError); ok {
+				return corruptAction
+			}
+			return decodeAction
+		},
+	}
+
+	var targets []mapper.Target
+	if *mapID != 0 {
+		var receipts source.ReceiptSource
+		if *geth != "" {
+			gc, err := ethclient.Dial(*geth)
+			if err != nil {
+				glog.Exitf("Failed to dial geth: %v", err)
+			}
+			receipts = source.NewEthClient(gc).(source.ReceiptSource)
+		}
+		targets = append(targets, mapper.Target{MapID: *mapID, Func: mapper.NewBalances(n, receipts)})
+	}
+	if *nonceMapID != 0 {
+		targets = append(targets, mapper.Target{MapID: *nonceMapID, Func: mapper.NewNonces(n)})
+	}
+	if *txMapID != 0 {
+		targets = append(targets, mapper.Target{MapID: *txMapID, Func: mapper.NewTxLookup(n)})
+	}
+	if *countMapID != 0 {
+		targets = append(targets, mapper.Target{MapID: *countMapID, Func: mapper.NewTxCounts(n)})
+	}
+
+	m := mapper.New(trillian.NewTrillianLogClient(tlc), *logID, trillian.NewTrillianMapClient(tmc), n, opts, targets...)
+	if *genesis != "" {
+		g, err := mapper.ReadGenesis(*genesis)
+		if err != nil {
+			glog.Exitf("Bad --genesis: %v", err)
+		}
+		if err := m.ApplyGenesis(ctx, *mapID, g); err != nil && ctx.Err() == nil {
+			glog.Exitf("Failed to apply genesis: %v", err)
+		}
+	}
+
+	err = m.Map(ctx, *from)
+	if ctx.Err() != nil {
+		glog.Info("Mapper stopped")
+		return
+	}
+	switch err.(type) {
+	case *mapper.CorruptLeafError:
+		glog.Exitf("Halted on corrupt map leaf: %v", err)
+	case *mapper.DecodeError:
+		glog.Exitf("Halted on bad log leaf: %v", err)
+	case *mapper.InconsistencyError:
+		glog.Exitf("Halted on inconsistent map: %v", err)
+	}
+	glog.Exitf("Mapper stopped: %v", err)
 }
@@ -21,12 +21,17 @@ import (
 	"github.com/golang/glog"
 	"github.com/google/trillian"
 	"github.com/google/trillian-examples/etherslurp/ui"
+	"github.com/google/trillian/crypto/keys/pem"
 	"google.golang.org/grpc"
 )
 
 var (
 	trillianMap = flag.String("trillian_map", "", "URL of the Trillian Map RPC server.")
 	mapID       = flag.Int64("map_id", 0, "Trillian MapID to populate.")
+	txMapID     = flag.Int64("tx_map_id", 0, "Trillian MapID of the transaction map, to enable transaction search.")
+	trillianLog = flag.String("trillian_log", "", "URL of the Trillian Log RPC server, needed for transaction search.")
+	logID       = flag.Int64("log_id", 0, "Trillian LogID of the log of blocks, needed for transaction search.")
+	logPubKey   = flag.String("log_public_key", "", "PEM file holding the log's public key, used to verify log roots.")
 	endpoint    = flag.String("http_endpint", "localhost:9001", "Address to bind HTTP server.")
 )
 
@@ -42,6 +47,25 @@ func main() {
 		glog.Exitf("Failed to dial Trillian Map: %v", err)
 	}
 
-	ui := ui.New(trillian.NewTrillianMapClient(tmc), *mapID)
+	var opts ui.Opts
+	if *txMapID != 0 {
+		if *logID == 0 {
+			glog.Exitf("Transaction search needs the log, set --log_id")
+		}
+		tlc, err := grpc.Dial(*trillianLog, grpc.WithInsecure())
+		if err != nil {
+			glog.Exitf("Failed to dial Trillian Log: %v", err)
+		}
+		opts = ui.Opts{TxMapID: *txMapID, Log: trillian.NewTrillianLogClient(tlc), LogID: *logID}
+		if *logPubKey != "" {
+			if opts.LogPublicKey, err = pem.ReadPublicKeyFile(*logPubKey); err != nil {
+				glog.Exitf("Failed to read log public key: %v", err)
+			}
+		} else {
+			glog.Warningf("No --log_public_key given, log roots will not be verified")
+		}
+	}
+
+	ui := ui.New(trillian.NewTrillianMapClient(tmc), *mapID, opts)
 	glog.Info(http.ListenAndServe(*endpoint, ui))
 }
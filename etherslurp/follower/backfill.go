@@ -0,0 +1,139 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package follower
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/golang/glog"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+)
+
+// fetchRange fetches the n blocks starting at from, one at a time, retrying until it
+// succeeds or ctx is done.
+func (f *Follower) fetchRange(ctx context.Context, from int64, n int64) ([]*blockleaf.Leaf, error) {
+	leaves := make([]*blockleaf.Leaf, 0, n)
+	for i := int64(0); i < n; {
+		l, err := f.fetchBlock(ctx, from+i)
+		if err != nil {
+			glog.Warningf("Failed to get block %d: %v", from+i, err)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		leaves = append(leaves, l)
+		i++
+	}
+	return leaves, nil
+}
+
+// backfill copies blocks [from, to] into the log. The blocks are split into ranges of
+// Opts.BackfillRange, which are fetched by Opts.BackfillWorkers workers in parallel,
+// and then reordered so that they're committed to the log strictly in order. It
+// returns the next block to be added and the hash of the block before it, which
+// reflect the ranges committed even if an error is returned.
+func (f *Follower) backfill(ctx context.Context, from, to int64, prevHash common.Hash) (int64, common.Hash, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	size := int64(f.opts.BackfillRange)
+	workers := f.opts.BackfillWorkers
+	glog.Infof("Backfilling blocks [%d, %d] with %d workers", from, to, workers)
+
+	type fetched struct {
+		start  int64
+		leaves []*blockleaf.Leaf
+	}
+	starts := make(chan int64)
+	results := make(chan fetched)
+	// tokens limits how many ranges can be fetched but not yet committed, which bounds
+	// the memory used when one slow range holds up the ones after it.
+	tokens := make(chan struct{}, 2*workers)
+
+	go func() {
+		defer close(starts)
+		for s := from; s <= to; s += size {
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case starts <- s:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		go func() {
+			for s := range starts {
+				n := size
+				if s+n > to+1 {
+					n = to + 1 - s
+				}
+				leaves, err := f.fetchRange(ctx, s, n)
+				if err != nil {
+					return
+				}
+				select {
+				case results <- fetched{start: s, leaves: leaves}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	next := from
+	ready := make(map[int64][]*blockleaf.Leaf)
+	for next <= to {
+		select {
+		case <-ctx.Done():
+			return next, prevHash, ctx.Err()
+		case r := <-results:
+			ready[r.start] = r.leaves
+		}
+
+		for {
+			leaves, ok := ready[next]
+			if !ok {
+				break
+			}
+			delete(ready, next)
+			for len(leaves) > 0 {
+				n := uint64(len(leaves))
+				if n > f.opts.BatchSize {
+					n = f.opts.BatchSize
+				}
+				hash, err := f.commit(ctx, leaves[:n], prevHash)
+				if err != nil {
+					return next, prevHash, err
+				}
+				prevHash = hash
+				next += int64(n)
+				leaves = leaves[n:]
+			}
+			<-tokens
+		}
+	}
+	glog.Infof("Backfill complete to block %d", to)
+	return next, prevHash, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package follower
+
+import (
+	"context"
+	"math/big"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+	"github.com/google/trillian-examples/etherslurp/source"
+)
+
+// slowSource serves blocks up to a head which the test moves on, taking a random
+// time over each block so that backfill workers finish out of order.
+type slowSource struct {
+	*source.File
+	mu   sync.Mutex
+	head uint64
+	rnd  *rand.Rand
+}
+
+func (s *slowSource) setHead(head uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.head = head
+}
+
+// wait sleeps for a random time, and returns the number of the block to serve, which
+// is the head if number is nil.
+func (s *slowSource) wait(number *big.Int) (*big.Int, error) {
+	s.mu.Lock()
+	d := time.Duration(s.rnd.Intn(5)) * time.Millisecond
+	head := s.head
+	s.mu.Unlock()
+	time.Sleep(d)
+
+	if number == nil {
+		return new(big.Int).SetUint64(head), nil
+	}
+	if number.Uint64() > head {
+		return nil, ethereum.NotFound
+	}
+	return number, nil
+}
+
+func (s *slowSource) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	n, err := s.wait(number)
+	if err != nil {
+		return nil, err
+	}
+	return s.File.BlockByNumber(ctx, n)
+}
+
+func (s *slowSource) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	n, err := s.wait(number)
+	if err != nil {
+		return nil, err
+	}
+	return s.File.HeaderByNumber(ctx, n)
+}
+
+func (s *slowSource) SyncProgress(ctx context.Context) (*ethereum.SyncProgress, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &ethereum.SyncProgress{CurrentBlock: s.head, HighestBlock: s.head}, nil
+}
+
+func TestBackfill(t *testing.T) {
+	blocks := testChain(100, 1)
+	file, err := source.NewBlocks(blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &slowSource{File: file, head: 40, rnd: rand.New(rand.NewSource(1))}
+	tl := newFakeLog()
+	f := New(src, tl, 1, Opts{BatchSize: 5, Workers: 2, BackfillWorkers: 4, BackfillRange: 7})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- f.Follow(ctx) }()
+
+	// The first and last heads are far enough ahead to be backfilled, and the one
+	// between them is followed block by block.
+	deadline := time.After(30 * time.Second)
+	for _, head := range []uint64{40, 43, 99} {
+		src.setHead(head)
+		for tl.size() <= int64(head) {
+			select {
+			case err := <-done:
+				t.Fatalf("Follow() returned early: %v", err)
+			case <-deadline:
+				t.Fatalf("Timed out at head %d with %d blocks in the log", head, tl.size())
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Follow() = %v, want %v", err, context.Canceled)
+	}
+
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if got, want := len(tl.added), len(blocks); got != want {
+		t.Errorf("Added %d leaves, want %d", got, want)
+	}
+	for i, idx := range tl.added {
+		if idx != int64(i) {
+			t.Fatalf("Leaf %d added was at index %d, want leaves added in order", i, idx)
+		}
+	}
+	if got, want := len(tl.leaves), len(blocks); got != want {
+		t.Errorf("Log has %d leaves, want %d", got, want)
+	}
+	for i, b := range blocks {
+		l, err := blockleaf.Decode(tl.leaves[int64(i)])
+		if err != nil {
+			t.Fatalf("Failed to decode block %d from log: %v", i, err)
+		}
+		if got, want := l.BlockHeader().Hash(), b.Hash(); got != want {
+			t.Errorf("Block %d in log has hash %x, want %x", i, got, want)
+		}
+	}
+}
@@ -15,114 +15,461 @@
 package follower
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"math/big"
+	"sync"
 	"time"
 
-	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/golang/glog"
 	"github.com/google/trillian"
-	"github.com/google/trillian/types"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+	"github.com/google/trillian-examples/etherslurp/chain"
+	"github.com/google/trillian-examples/etherslurp/source"
+	"github.com/google/trillian/client"
+	ttypes "github.com/google/trillian/types"
+	"google.golang.org/grpc/codes"
 )
 
 // Opts encapsulates the options that can be used with a Follower.
 type Opts struct {
+	// BatchSize is the maximum number of blocks added to the log in one request.
 	BatchSize uint64
+	// Workers is the number of blocks fetched concurrently from geth.
+	Workers int
+	// Confirmations is the number of blocks which must follow a block on the chain
+	// before it's added to the log.
+	Confirmations uint64
+	// Verifier, if set, is used to check the signature of every log root the Follower
+	// uses, and the consistency of each root with the one before it.
+	Verifier *client.LogVerifier
+	// OnIntegrityFailure, if set, is called with an *IntegrityError before Follow
+	// returns it.
+	OnIntegrityFailure func(error)
+	// StateFile, if set, is where the Follower keeps a record of the blocks which it
+	// has confirmed are integrated into the log. On restart it's checked against the
+	// log, and the Follower resumes after the last confirmed block.
+	StateFile string
+	// Receipts causes the receipts for each block's transactions to be logged along
+	// with the block. The Follower's source must be a source.ReceiptSource.
+	Receipts bool
+	// HeadersOnly causes only block headers to be logged, rather than whole blocks.
+	HeadersOnly bool
+	// SealVerifier, if set, is used to check the seal on each block before it's logged.
+	SealVerifier SealVerifier
+	// Network, if set, is the network the log is for. The Follower refuses to run if
+	// its source or the log are for a different network.
+	Network *chain.Network
+	// BackfillWorkers, if non-zero, is the number of workers used to fetch blocks when
+	// the Follower is at least BackfillRange blocks behind the chain.
+	BackfillWorkers int
+	// BackfillRange is the number of consecutive blocks each backfill worker fetches
+	// at a time.
+	BackfillRange uint64
+	// MaxPending is the most blocks which can have been added to the log without yet
+	// being confirmed as integrated. The Follower waits for the log to catch up
+	// before adding more.
+	MaxPending int
 }
 
-// Follower provides functionality for reading blocks added to Ethereum and then queuing
-// them into a Trillian Log.
+// ReorgError is returned by Follow when the chain no longer contains the last block
+// added to the log, i.e. the chain has been reorganised deeper than Opts.Confirmations.
+type ReorgError struct {
+	// Number is the block which doesn't follow on from the log.
+	Number     int64
+	ParentHash common.Hash
+	// LoggedHash is the hash of block Number-1 in the log.
+	LoggedHash common.Hash
+}
+
+func (e *ReorgError) Error() string {
+	return fmt.Sprintf("chain reorganised: block %d has parent %x, but the log has block %d with hash %x", e.Number, e.ParentHash, e.Number-1, e.LoggedHash)
+}
+
+// Follower provides functionality for reading blocks added to Ethereum and then adding
+// them to a Trillian Log. The Log must be a PREORDERED_LOG, as each block is added at the
+// leaf index equal to its block number.
 type Follower struct {
 	logID int64
-	gc    *ethclient.Client
+	src   source.BlockSource
 	tc    trillian.TrillianLogClient
 
 	opts Opts
+	// trusted is the latest log root which has been verified.
+	trusted *ttypes.LogRootV1
+
+	// pending is the blocks which have been added to the log but not yet confirmed
+	// as integrated, in order.
+	pending []pendingLeaf
+	// sealNext is the block a StatefulSealVerifier expects next, or -1 if it needs to
+	// be given the headers from the log again.
+	sealNext int64
+
+	// mu guards started and status, which are read by ServeHTTP.
+	mu      sync.Mutex
+	started time.Time
+	status  Status
 }
 
 // New creates a new Follower.
-func New(gc *ethclient.Client, tc trillian.TrillianLogClient, logID int64, opts Opts) *Follower {
+func New(src source.BlockSource, tc trillian.TrillianLogClient, logID int64, opts Opts) *Follower {
 	if opts.BatchSize <= 0 {
 		opts.BatchSize = 100
 	}
+	if opts.Workers <= 0 {
+		opts.Workers = 10
+	}
+	if opts.BackfillRange <= 0 {
+		opts.BackfillRange = 1000
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = 10000
+	}
 	return &Follower{
-		logID: logID,
-		gc:    gc,
-		tc:    tc,
-		opts:  opts,
+		logID:    logID,
+		src:      src,
+		tc:       tc,
+		opts:     opts,
+		sealNext: -1,
+	}
+}
+
+// addSequenced adds leaves to the log at their given indices. Leaves which are already
+// present, e.g. because they were added before a restart but hadn't been integrated
+// when we read the tree size, are not an error, so retrying is always safe.
+func (f *Follower) addSequenced(ctx context.Context, leaves []*trillian.LogLeaf) error {
+	rsp, err := f.tc.AddSequencedLeaves(ctx, &trillian.AddSequencedLeavesRequest{LogId: f.logID, Leaves: leaves})
+	if err != nil {
+		return err
+	}
+	for _, r := range rsp.Results {
+		switch c := codes.Code(r.GetStatus().GetCode()); c {
+		case codes.OK:
+		case codes.AlreadyExists:
+			glog.V(1).Infof("Block %d already present in log", r.GetLeaf().GetLeafIndex())
+		default:
+			return fmt.Errorf("bad status for block %d: %v", r.GetLeaf().GetLeafIndex(), r.GetStatus())
+		}
+	}
+	return nil
+}
+
+// fetchBlocks fetches the n blocks starting at from from the source, along with their
+// receipts if Opts.Receipts is set. Up to Opts.Workers blocks are fetched at once, and
+// they're returned in order.
+func (f *Follower) fetchBlocks(ctx context.Context, from int64, n int) ([]*blockleaf.Leaf, error) {
+	leaves := make([]*blockleaf.Leaf, n)
+	errs := make([]error, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < f.opts.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				leaves[i], errs[i] = f.fetchBlock(ctx, from+int64(i))
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("failed to get block %d: %v", from+int64(i), err)
+		}
+	}
+	return leaves, nil
+}
+
+func (f *Follower) fetchBlock(ctx context.Context, num int64) (*blockleaf.Leaf, error) {
+	if f.opts.HeadersOnly {
+		h, err := f.src.HeaderByNumber(ctx, big.NewInt(num))
+		if err != nil {
+			return nil, err
+		}
+		return &blockleaf.Leaf{Version: blockleaf.VersionHeader, Header: h}, nil
+	}
+
+	b, err := f.src.BlockByNumber(ctx, big.NewInt(num))
+	if err != nil {
+		return nil, err
+	}
+	if !f.opts.Receipts {
+		return &blockleaf.Leaf{Version: blockleaf.VersionBlock, Block: b}, nil
+	}
+
+	rs := f.src.(source.ReceiptSource)
+	l := &blockleaf.Leaf{Version: blockleaf.VersionBlockReceipts, Block: b}
+	for _, tx := range b.Transactions() {
+		r, err := rs.TransactionReceipt(ctx, tx.Hash())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get receipt for tx %x: %v", tx.Hash(), err)
+		}
+		l.Receipts = append(l.Receipts, r)
+	}
+	return l, nil
+}
+
+// loggedHeader returns the header of the block at index n in the log.
+func (f *Follower) loggedHeader(ctx context.Context, n int64) (*types.Header, error) {
+	rsp, err := f.tc.GetLeavesByIndex(ctx, &trillian.GetLeavesByIndexRequest{LogId: f.logID, LeafIndex: []int64{n}})
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp.Leaves) != 1 {
+		return nil, fmt.Errorf("got %d leaves, expected 1", len(rsp.Leaves))
+	}
+	l, err := blockleaf.Decode(rsp.Leaves[0].LeafValue)
+	if err != nil {
+		return nil, err
+	}
+	return l.BlockHeader(), nil
+}
+
+// loggedHash returns the hash of the block at index n in the log.
+func (f *Follower) loggedHash(ctx context.Context, n int64) (common.Hash, error) {
+	h, err := f.loggedHeader(ctx, n)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return h.Hash(), nil
+}
+
+// checkSource returns an error if the source is not for Opts.Network. Its genesis block
+// is only checked if it has one.
+func (f *Follower) checkSource(ctx context.Context) error {
+	n := f.opts.Network
+	if ns, ok := f.src.(source.NetworkSource); ok {
+		id, err := ns.NetworkID(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get network ID: %v", err)
+		}
+		if err := n.CheckChainID(id); err != nil {
+			return fmt.Errorf("source is not for %s: %v", n.Name, err)
+		}
+	}
+	// A source such as a file of exported blocks needn't start at genesis, in which
+	// case it's tied to the network by following on from the blocks in the log.
+	h, err := f.src.HeaderByNumber(ctx, big.NewInt(0))
+	if err == ethereum.NotFound {
+		glog.Infof("Source has no genesis block, not checking it is for %s", n.Name)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get genesis block: %v", err)
 	}
+	if err := n.CheckGenesis(h); err != nil {
+		return fmt.Errorf("source is not for %s: %v", n.Name, err)
+	}
+	return nil
 }
 
 // Follow begins operations to copy blocks into the log. This will continue until the provided
-// context expires or is cancelled.
-func (f *Follower) Follow(ctx context.Context) {
+// context expires or is cancelled, or the chain diverges from the blocks already in the log,
+// in which case a *ReorgError is returned, or a log root fails verification, in which case
+// an *IntegrityError is returned, or a block's seal fails verification, in which case a
+// *SealError is returned.
+func (f *Follower) Follow(ctx context.Context) error {
+	if _, ok := f.src.(source.ReceiptSource); f.opts.Receipts && !ok {
+		return errors.New("receipts requested, but source does not provide them")
+	}
+	if f.opts.Receipts && f.opts.HeadersOnly {
+		return errors.New("receipts can't be logged with headers only")
+	}
+	if f.opts.Network != nil {
+		if err := f.checkSource(ctx); err != nil {
+			return err
+		}
+	}
+	if err := f.loadState(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.started = time.Now()
+	f.mu.Unlock()
 	ticker := time.NewTicker(time.Second)
 	nextBlock := int64(-1)
+	// prevHash is the hash of block nextBlock-1 in the log.
+	var prevHash common.Hash
 nextAttempt:
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return ctx.Err()
 		case <-ticker.C:
 		}
 
-		// Get initial STH, if necessary:
+		// Keep checking the log's root, so that a log which forks is noticed while
+		// we're running.
+		logRoot, err := f.updateRoot(ctx)
+		if _, ok := err.(*IntegrityError); ok {
+			return err
+		} else if err != nil {
+			glog.Warningf("Failed to get log root: %v", err)
+			continue
+		}
+		f.mu.Lock()
+		f.status.TreeSize = logRoot.TreeSize
+		f.mu.Unlock()
+
+		// Get starting position, if necessary:
 		if nextBlock < 0 {
-			sth, err := f.tc.GetLatestSignedLogRoot(ctx, &trillian.GetLatestSignedLogRootRequest{LogId: f.logID})
-			if err != nil {
-				continue
+			if f.opts.Network != nil && logRoot.TreeSize > 0 {
+				h, err := f.loggedHeader(ctx, 0)
+				if err != nil {
+					glog.Errorf("Failed to get genesis block from log: %v", err)
+					continue
+				}
+				if err := f.opts.Network.CheckGenesis(h); err != nil {
+					return fmt.Errorf("log is not for %s: %v", f.opts.Network.Name, err)
+				}
 			}
-			// TODO(al): Check signature of root before using it.
-			var logRoot types.LogRootV1
-			if err := logRoot.UnmarshalBinary(sth.SignedLogRoot.LogRoot); err != nil {
-				glog.Warningf("Log root did not unmarshal: %v", err)
+			next, hash, err := f.reconcile(ctx, logRoot)
+			if _, ok := err.(*IntegrityError); ok {
+				return err
+			} else if err != nil {
+				glog.Errorf("Failed to reconcile state with log: %v", err)
 				continue
 			}
-			nextBlock = int64(logRoot.TreeSize)
-			glog.Infof("Got starting STH of:\n%+v", sth)
+			nextBlock, prevHash = next, hash
+			f.mu.Lock()
+			f.status.NextBlock = nextBlock
+			f.mu.Unlock()
+			glog.Infof("Got starting log root of:\n%+v", logRoot)
 		}
 
-		sync, err := f.gc.SyncProgress(ctx)
+		if err := f.confirm(ctx, logRoot); err != nil {
+			if _, ok := err.(*IntegrityError); ok {
+				return err
+			}
+			glog.Warningf("Failed to confirm blocks: %v", err)
+		}
+
+		progress, err := f.src.SyncProgress(ctx)
 		if err != nil {
 			glog.Errorf("Failed to get sync progress: %v", err)
 			continue
 		}
-		if sync == nil {
+		if progress == nil {
 			glog.Errorf("No sync progress, perhaps geth hasn't got any data yet?")
 			continue
 		}
+		f.mu.Lock()
+		f.status.Head = progress.CurrentBlock
+		f.mu.Unlock()
 
-		if sync.CurrentBlock <= uint64(nextBlock) {
-			continue
-		}
-		for ; uint64(nextBlock) < sync.CurrentBlock; nextBlock++ {
-			b, err := f.gc.BlockByNumber(ctx, big.NewInt(nextBlock))
-			if err != nil {
-				glog.Errorf("Failed to get block %v: %v", nextBlock, err)
-				continue nextAttempt
+		// Only blocks with enough confirmations are logged, so that they're unlikely
+		// to be reorganised out of the chain.
+		for uint64(nextBlock)+f.opts.Confirmations <= progress.CurrentBlock {
+			last := int64(progress.CurrentBlock - f.opts.Confirmations)
+			if f.opts.BackfillWorkers > 0 && uint64(last-nextBlock) >= f.opts.BackfillRange {
+				nextBlock, prevHash, err = f.backfill(ctx, nextBlock, last, prevHash)
+				if fatal(err) {
+					return err
+				} else if err != nil {
+					glog.Errorf("Backfill stopped at block %d: %v", nextBlock, err)
+					continue nextAttempt
+				}
+				continue
 			}
-			raw := bytes.Buffer{}
-			if err := b.EncodeRLP(&raw); err != nil {
-				glog.Errorf("Error serialising block %v: %v", nextBlock, err)
-				continue nextAttempt
+
+			n := uint64(last-nextBlock) + 1
+			if n > f.opts.BatchSize {
+				n = f.opts.BatchSize
 			}
-			leaf := &trillian.LogLeaf{
-				LeafValue: raw.Bytes(),
+			blocks, err := f.fetchBlocks(ctx, nextBlock, int(n))
+			if err != nil {
+				glog.Errorf("Failed to fetch blocks: %v", err)
+				continue nextAttempt
 			}
-			// TODO(al): actually batch.
-			// XXX obviously, this is going to result in the blocks being all
-			// out-of-order with respect to the chain due to Trillian sequencing.
-			// either we can use the Mirroring APIs once they're ready, or use the
-			// hash chain hashes to sort it out in the wash when we construct the
-			// Map from the entries in the Log.
-			if _, err := f.tc.QueueLeaves(ctx, &trillian.QueueLeavesRequest{LogId: f.logID, Leaves: []*trillian.LogLeaf{leaf}}); err != nil {
-				glog.Errorf("Failed to Queue block %v: %v", nextBlock, err)
+			hash, err := f.commit(ctx, blocks, prevHash)
+			if fatal(err) {
+				return err
+			} else if err != nil {
+				glog.Errorf("Failed to add blocks [%d, %d): %v", nextBlock, nextBlock+int64(len(blocks)), err)
 				continue nextAttempt
 			}
-			if nextBlock%1000 == 0 {
-				glog.Infof("Copied to %v", nextBlock)
+			prevHash = hash
+			nextBlock += int64(len(blocks))
+		}
+	}
+}
+
+// fatal reports whether err should stop the Follower.
+func fatal(err error) bool {
+	switch err.(type) {
+	case *ReorgError, *SealError, *IntegrityError:
+		return true
+	}
+	return false
+}
+
+// commit checks that blocks are consecutive and follow on from the block with hash
+// prevHash, and adds them to the log. It returns the hash of the last block. Nothing
+// is committed if there's an error, so a failed commit can be retried with the same
+// blocks.
+func (f *Follower) commit(ctx context.Context, blocks []*blockleaf.Leaf, prevHash common.Hash) (common.Hash, error) {
+	if err := f.waitForPending(ctx); err != nil {
+		return prevHash, err
+	}
+	if err := f.replaySeals(ctx, blocks[0].BlockHeader().Number.Int64()); err != nil {
+		return prevHash, err
+	}
+	// A stateful seal verifier has seen the blocks by the time anything can go
+	// wrong, so it has to be given the log's headers again before a retry.
+	committed := false
+	defer func() {
+		if !committed {
+			f.sealNext = -1
+		}
+	}()
+	leaves := make([]*trillian.LogLeaf, 0, len(blocks))
+	pending := make([]pendingLeaf, 0, len(blocks))
+	hash := prevHash
+	for _, l := range blocks {
+		h := l.BlockHeader()
+		num := h.Number.Int64()
+		if num > 0 && h.ParentHash != hash {
+			return prevHash, &ReorgError{Number: num, ParentHash: h.ParentHash, LoggedHash: hash}
+		}
+		if f.opts.SealVerifier != nil {
+			if err := f.opts.SealVerifier.VerifySeal(h); err != nil {
+				return prevHash, &SealError{Number: num, Err: err}
 			}
 		}
+		raw, err := blockleaf.Encode(l)
+		if err != nil {
+			return prevHash, fmt.Errorf("error serialising block %v: %v", num, err)
+		}
+		leaves = append(leaves, &trillian.LogLeaf{
+			LeafIndex: num,
+			LeafValue: raw,
+		})
+		hash = h.Hash()
+		pending = append(pending, pendingLeaf{index: num, leafHash: sha256.Sum256(raw), blockHash: hash})
 	}
+	if err := f.addSequenced(ctx, leaves); err != nil {
+		return prevHash, err
+	}
+	f.pending = append(f.pending, pending...)
+
+	next := pending[len(pending)-1].index + 1
+	committed = true
+	f.sealNext = next
+	f.mu.Lock()
+	f.status.NextBlock = next
+	f.status.Added += uint64(len(leaves))
+	added := f.status.Added
+	started := f.started
+	f.mu.Unlock()
+	glog.Infof("Copied to %v (%.1f blocks/s overall)", next-1, float64(added)/time.Since(started).Seconds())
+	return hash, nil
 }
@@ -0,0 +1,239 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package follower
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+	"github.com/google/trillian-examples/etherslurp/source"
+	"github.com/google/trillian-examples/etherslurp/testonly"
+	ttypes "github.com/google/trillian/types"
+	"google.golang.org/grpc"
+)
+
+// fakeLog is an in-memory pre-ordered log, which integrates leaves as soon as they're
+// added.
+type fakeLog struct {
+	trillian.TrillianLogClient
+	mu     sync.Mutex
+	leaves map[int64][]byte
+	// added lists the index of every leaf added, in the order they were added.
+	added []int64
+}
+
+func newFakeLog() *fakeLog {
+	return &fakeLog{leaves: make(map[int64][]byte)}
+}
+
+// size returns the number of contiguous leaves from index 0.
+func (l *fakeLog) size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := int64(0)
+	for l.leaves[n] != nil {
+		n++
+	}
+	return n
+}
+
+func (l *fakeLog) GetLatestSignedLogRoot(ctx context.Context, req *trillian.GetLatestSignedLogRootRequest, opts ...grpc.CallOption) (*trillian.GetLatestSignedLogRootResponse, error) {
+	root, err := (&ttypes.LogRootV1{TreeSize: uint64(l.size())}).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &trillian.GetLatestSignedLogRootResponse{SignedLogRoot: &trillian.SignedLogRoot{LogRoot: root}}, nil
+}
+
+func (l *fakeLog) AddSequencedLeaves(ctx context.Context, req *trillian.AddSequencedLeavesRequest, opts ...grpc.CallOption) (*trillian.AddSequencedLeavesResponse, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rsp := &trillian.AddSequencedLeavesResponse{}
+	for _, leaf := range req.Leaves {
+		l.leaves[leaf.LeafIndex] = leaf.LeafValue
+		l.added = append(l.added, leaf.LeafIndex)
+		rsp.Results = append(rsp.Results, &trillian.QueuedLogLeaf{Leaf: leaf})
+	}
+	return rsp, nil
+}
+
+func (l *fakeLog) GetLeavesByIndex(ctx context.Context, req *trillian.GetLeavesByIndexRequest, opts ...grpc.CallOption) (*trillian.GetLeavesByIndexResponse, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rsp := &trillian.GetLeavesByIndexResponse{}
+	for _, i := range req.LeafIndex {
+		if v := l.leaves[i]; v != nil {
+			rsp.Leaves = append(rsp.Leaves, &trillian.LogLeaf{LeafIndex: i, LeafValue: v})
+		}
+	}
+	return rsp, nil
+}
+
+// testChain returns n consecutive blocks from genesis, whose difficulty is d so that
+// different chains can be made.
+func testChain(n int, d int64) []*types.Block {
+	return testonly.Chain(0, n, func(h *types.Header) { h.Difficulty = big.NewInt(d) })
+}
+
+func TestFollow(t *testing.T) {
+	blocks := testChain(20, 1)
+	src, err := source.NewBlocks(blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := newFakeLog()
+	f := New(src, tl, 1, Opts{BatchSize: 8, Workers: 3})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- f.Follow(ctx) }()
+
+	deadline := time.After(10 * time.Second)
+	for confirmed := int64(-1); confirmed < int64(len(blocks))-1; {
+		select {
+		case err := <-done:
+			t.Fatalf("Follow() returned early: %v", err)
+		case <-deadline:
+			t.Fatalf("Timed out with blocks confirmed up to %d", confirmed)
+		case <-time.After(100 * time.Millisecond):
+		}
+		f.mu.Lock()
+		confirmed = f.status.Confirmed.Block
+		f.mu.Unlock()
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Follow() = %v, want %v", err, context.Canceled)
+	}
+
+	if got, want := tl.size(), int64(len(blocks)); got != want {
+		t.Fatalf("Log has %d blocks, want %d", got, want)
+	}
+	for i, b := range blocks {
+		l, err := blockleaf.Decode(tl.leaves[int64(i)])
+		if err != nil {
+			t.Fatalf("Failed to decode block %d from log: %v", i, err)
+		}
+		if got, want := l.BlockHeader().Hash(), b.Hash(); got != want {
+			t.Errorf("Block %d in log has hash %x, want %x", i, got, want)
+		}
+	}
+}
+
+func TestFollowReorg(t *testing.T) {
+	tl := newFakeLog()
+	for i, b := range testChain(5, 1) {
+		raw, err := blockleaf.Encode(&blockleaf.Leaf{Version: blockleaf.VersionBlock, Block: b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tl.leaves[int64(i)] = raw
+	}
+	src, err := source.NewBlocks(testChain(10, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := New(src, tl, 1, Opts{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = f.Follow(ctx)
+	if re, ok := err.(*ReorgError); !ok {
+		t.Fatalf("Follow() = %v, want *ReorgError", err)
+	} else if re.Number != 5 {
+		t.Errorf("Follow() reorg at block %d, want 5", re.Number)
+	}
+	if got := tl.size(); got != 5 {
+		t.Errorf("Log has %d blocks after reorg, want 5", got)
+	}
+}
+
+func TestFollowResumesFromState(t *testing.T) {
+	blocks := testChain(10, 1)
+	tl := newFakeLog()
+	for i, b := range blocks[:6] {
+		raw, err := blockleaf.Encode(&blockleaf.Leaf{Version: blockleaf.VersionBlock, Block: b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tl.leaves[int64(i)] = raw
+	}
+	dir, err := ioutil.TempDir("", "follower_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state")
+	// Blocks 4 and 5 were added but not confirmed before the restart.
+	j, err := json.Marshal(State{Block: 3, Hash: blocks[3].Hash()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(stateFile, j, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := source.NewBlocks(blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := New(src, tl, 1, Opts{StateFile: stateFile})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	done := make(chan error)
+	go func() { done <- f.Follow(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for {
+		f.mu.Lock()
+		s := f.status
+		f.mu.Unlock()
+		if s.Confirmed.Block == int64(len(blocks))-1 {
+			if got, want := s.Added, uint64(len(blocks)-4); got != want {
+				t.Errorf("Added %d blocks, want %d", got, want)
+			}
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Timed out with blocks confirmed up to %d", s.Confirmed.Block)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	j, err = ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s State
+	if err := json.Unmarshal(j, &s); err != nil {
+		t.Fatal(err)
+	}
+	if want := (State{Block: 9, Hash: blocks[9].Hash()}); s != want {
+		t.Errorf("State file has %+v, want %+v", s, want)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package follower
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/google/trillian"
+	ttypes "github.com/google/trillian/types"
+)
+
+// IntegrityError is returned by Follow when the log returns a root which fails
+// verification, either because its signature is bad or because it isn't consistent
+// with a root seen earlier.
+type IntegrityError struct {
+	Err error
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("log integrity failure: %v", e.Err)
+}
+
+// integrityFailure reports err to Opts.OnIntegrityFailure, if set, and returns it
+// wrapped in an IntegrityError.
+func (f *Follower) integrityFailure(err error) error {
+	ie := &IntegrityError{Err: err}
+	if f.opts.OnIntegrityFailure != nil {
+		f.opts.OnIntegrityFailure(ie)
+	}
+	return ie
+}
+
+// updateRoot fetches the latest root from the log and, if Opts.Verifier is set,
+// checks its signature and that it's consistent with the last root it returned. An
+// *IntegrityError is returned if verification fails, any other error is transient.
+func (f *Follower) updateRoot(ctx context.Context) (*ttypes.LogRootV1, error) {
+	sth, err := f.tc.GetLatestSignedLogRoot(ctx, &trillian.GetLatestSignedLogRootRequest{LogId: f.logID})
+	if err != nil {
+		return nil, err
+	}
+	var root ttypes.LogRootV1
+	if err := root.UnmarshalBinary(sth.SignedLogRoot.LogRoot); err != nil {
+		return nil, f.integrityFailure(fmt.Errorf("log root did not unmarshal: %v", err))
+	}
+
+	if f.opts.Verifier == nil {
+		f.trusted = &root
+		return f.trusted, nil
+	}
+
+	trusted := f.trusted
+	if trusted == nil {
+		trusted = &ttypes.LogRootV1{}
+	}
+	if root.TreeSize < trusted.TreeSize {
+		return nil, f.integrityFailure(fmt.Errorf("tree size went from %d to %d", trusted.TreeSize, root.TreeSize))
+	}
+	var consistency [][]byte
+	if trusted.TreeSize > 0 && root.TreeSize > trusted.TreeSize {
+		proof, err := f.tc.GetConsistencyProof(ctx, &trillian.GetConsistencyProofRequest{
+			LogId:          f.logID,
+			FirstTreeSize:  int64(trusted.TreeSize),
+			SecondTreeSize: int64(root.TreeSize),
+		})
+		if err != nil {
+			return nil, err
+		}
+		consistency = proof.GetProof().GetHashes()
+	}
+	verified, err := f.opts.Verifier.VerifyRoot(trusted, sth.SignedLogRoot, consistency)
+	if err != nil {
+		return nil, f.integrityFailure(fmt.Errorf("root at tree size %d failed verification: %v", root.TreeSize, err))
+	}
+	if f.trusted == nil || verified.TreeSize != f.trusted.TreeSize {
+		glog.V(1).Infof("Verified log root at tree size %d", verified.TreeSize)
+	}
+	f.trusted = verified
+	return f.trusted, nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package follower
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian/client"
+	tcrypto "github.com/google/trillian/crypto"
+	"github.com/google/trillian/merkle/rfc6962"
+	ttypes "github.com/google/trillian/types"
+	"google.golang.org/grpc"
+)
+
+// rootLog is a log client which returns the given roots in turn, and a fixed
+// consistency proof.
+type rootLog struct {
+	trillian.TrillianLogClient
+	roots       []*trillian.SignedLogRoot
+	consistency [][]byte
+	proofErr    error
+}
+
+func (l *rootLog) GetLatestSignedLogRoot(ctx context.Context, req *trillian.GetLatestSignedLogRootRequest, opts ...grpc.CallOption) (*trillian.GetLatestSignedLogRootResponse, error) {
+	r := l.roots[0]
+	l.roots = l.roots[1:]
+	return &trillian.GetLatestSignedLogRootResponse{SignedLogRoot: r}, nil
+}
+
+func (l *rootLog) GetConsistencyProof(ctx context.Context, req *trillian.GetConsistencyProofRequest, opts ...grpc.CallOption) (*trillian.GetConsistencyProofResponse, error) {
+	if l.proofErr != nil {
+		return nil, l.proofErr
+	}
+	return &trillian.GetConsistencyProofResponse{Proof: &trillian.Proof{Hashes: l.consistency}}, nil
+}
+
+// testTree holds the hashes of a log of four leaves.
+type testTree struct {
+	leaves [4][]byte
+}
+
+func newTestTree(t *testing.T, prefix string) *testTree {
+	t.Helper()
+	var tt testTree
+	for i := range tt.leaves {
+		h, err := rfc6962.DefaultHasher.HashLeaf([]byte{prefix[0], byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.leaves[i] = h
+	}
+	return &tt
+}
+
+// root returns the root hash of the first size leaves, for a size of 2 or 4.
+func (tt *testTree) root(size int) []byte {
+	h := rfc6962.DefaultHasher
+	left := h.HashChildren(tt.leaves[0], tt.leaves[1])
+	if size == 2 {
+		return left
+	}
+	return h.HashChildren(left, tt.right())
+}
+
+// right is the consistency proof from size 2 to size 4.
+func (tt *testTree) right() []byte {
+	return rfc6962.DefaultHasher.HashChildren(tt.leaves[2], tt.leaves[3])
+}
+
+func TestUpdateRoot(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := tcrypto.NewSigner(0, key, crypto.SHA256)
+	sign := func(size uint64, hash []byte) *trillian.SignedLogRoot {
+		slr, err := signer.SignLogRoot(&ttypes.LogRootV1{TreeSize: size, RootHash: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return slr
+	}
+	good := newTestTree(t, "a")
+	other := newTestTree(t, "b")
+
+	tampered := sign(4, good.root(4))
+	var r ttypes.LogRootV1
+	if err := r.UnmarshalBinary(tampered.LogRoot); err != nil {
+		t.Fatal(err)
+	}
+	r.TreeSize = 3
+	if tampered.LogRoot, err = r.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc        string
+		roots       []*trillian.SignedLogRoot
+		consistency [][]byte
+		proofErr    error
+		// wantIntegrity is whether the last root fails verification. If wantErr is
+		// set, it fails for some other reason.
+		wantIntegrity bool
+		wantErr       bool
+	}{
+		{
+			desc:        "consistent",
+			roots:       []*trillian.SignedLogRoot{sign(2, good.root(2)), sign(4, good.root(4))},
+			consistency: [][]byte{good.right()},
+		},
+		{
+			desc:  "same root again",
+			roots: []*trillian.SignedLogRoot{sign(2, good.root(2)), sign(2, good.root(2))},
+		},
+		{
+			desc:          "bad signature",
+			roots:         []*trillian.SignedLogRoot{sign(2, good.root(2)), tampered},
+			consistency:   [][]byte{good.right()},
+			wantIntegrity: true,
+		},
+		{
+			desc:          "inconsistent",
+			roots:         []*trillian.SignedLogRoot{sign(2, good.root(2)), sign(4, other.root(4))},
+			consistency:   [][]byte{other.right()},
+			wantIntegrity: true,
+		},
+		{
+			desc:          "forked at the same size",
+			roots:         []*trillian.SignedLogRoot{sign(2, good.root(2)), sign(2, other.root(2))},
+			wantIntegrity: true,
+		},
+		{
+			desc:          "shrunk",
+			roots:         []*trillian.SignedLogRoot{sign(4, good.root(4)), sign(2, good.root(2))},
+			wantIntegrity: true,
+		},
+		{
+			desc:     "no consistency proof",
+			roots:    []*trillian.SignedLogRoot{sign(2, good.root(2)), sign(4, good.root(4))},
+			proofErr: errors.New("log unavailable"),
+			wantErr:  true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			var reported error
+			tl := &rootLog{roots: tc.roots, consistency: tc.consistency, proofErr: tc.proofErr}
+			f := New(nil, tl, 1, Opts{
+				Verifier:           client.NewLogVerifier(rfc6962.DefaultHasher, &key.PublicKey, crypto.SHA256),
+				OnIntegrityFailure: func(err error) { reported = err },
+			})
+			ctx := context.Background()
+			first, err := f.updateRoot(ctx)
+			if err != nil {
+				t.Fatalf("updateRoot() of first root: %v", err)
+			}
+
+			got, err := f.updateRoot(ctx)
+			_, integrity := err.(*IntegrityError)
+			switch {
+			case tc.wantIntegrity:
+				if !integrity {
+					t.Errorf("updateRoot() = %v, want *IntegrityError", err)
+				}
+				if reported != err {
+					t.Errorf("OnIntegrityFailure got %v, want %v", reported, err)
+				}
+			case tc.wantErr:
+				if err == nil || integrity {
+					t.Errorf("updateRoot() = %v, want a transient error", err)
+				}
+			case err != nil:
+				t.Errorf("updateRoot(): %v", err)
+			default:
+				if f.trusted != got {
+					t.Error("updateRoot() didn't trust the verified root")
+				}
+				return
+			}
+			if f.trusted != first {
+				t.Errorf("After failure, trusted root is %+v, want %+v", f.trusted, first)
+			}
+		})
+	}
+}
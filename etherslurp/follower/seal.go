@@ -0,0 +1,385 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package follower
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/clique"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/golang/glog"
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+)
+
+// SealVerifier checks the seal on a block header, i.e. its proof-of-work or signature.
+type SealVerifier interface {
+	VerifySeal(h *types.Header) error
+}
+
+// SealError is returned by Follow when a block's seal fails verification.
+type SealError struct {
+	Number int64
+	Err    error
+}
+
+func (e *SealError) Error() string {
+	return fmt.Sprintf("bad seal on block %d: %v", e.Number, e.Err)
+}
+
+type ethashVerifier struct {
+	e *ethash.Ethash
+}
+
+// NewEthashVerifier returns a SealVerifier which checks ethash proof-of-work. The
+// verification caches are kept in dir.
+func NewEthashVerifier(dir string) SealVerifier {
+	return ethashVerifier{ethash.New(ethash.Config{CacheDir: dir, CachesInMem: 2, CachesOnDisk: 3})}
+}
+
+func (v ethashVerifier) VerifySeal(h *types.Header) error {
+	// Verifying the seal alone doesn't need access to the rest of the chain.
+	return v.e.VerifySeal(nil, h)
+}
+
+// Sizes of the parts of a clique header's extra-data.
+const (
+	cliqueExtraVanity = 32
+	cliqueExtraSeal   = 65
+	// cliqueDefaultEpoch is the epoch clique uses if the config doesn't set one.
+	cliqueDefaultEpoch = 30000
+)
+
+// Nonces of clique headers which vote on their Coinbase, and the difficulties of
+// headers signed in and out of turn.
+var (
+	cliqueNonceAuth = types.BlockNonce{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	cliqueNonceDrop = types.BlockNonce{}
+
+	cliqueDiffInTurn = big.NewInt(2)
+	cliqueDiffNoTurn = big.NewInt(1)
+)
+
+// StatefulSealVerifier is a SealVerifier whose verdict on a header depends on the
+// headers before it. Before the Follower adds blocks starting anywhere but straight
+// after the last ones it verified, such as when it starts, it resets the verifier and
+// verifies the headers in the log from ReplayFrom onwards.
+type StatefulSealVerifier interface {
+	SealVerifier
+	// ReplayFrom returns the first block which must be verified in order to be able
+	// to verify block n.
+	ReplayFrom(n uint64) uint64
+	// Reset forgets every header verified so far.
+	Reset()
+}
+
+// cliqueVote is a vote by signer to authorise or drop address.
+type cliqueVote struct {
+	signer    common.Address
+	address   common.Address
+	authorize bool
+}
+
+// cliqueTally is the number of votes to authorise or drop an address.
+type cliqueTally struct {
+	authorize bool
+	votes     int
+}
+
+// cliqueVerifier follows clique's snapshots of the signer set, as in
+// consensus/clique/snapshot.go.
+type cliqueVerifier struct {
+	c     *clique.Clique
+	epoch uint64
+	// signers is nil until a checkpoint has been verified.
+	signers map[common.Address]bool
+	// recents holds who signed recent blocks, by block number.
+	recents map[uint64]common.Address
+	votes   []cliqueVote
+	tally   map[common.Address]cliqueTally
+}
+
+// NewCliqueVerifier returns a SealVerifier which checks that clique headers are signed
+// by an authorised signer who hasn't signed too recently, with the difficulty for
+// whether it was the signer's turn, and that their votes and extra-data are well
+// formed, as geth does. The signers are taken from
+// the signer list in the last epoch checkpoint, the first of which is the genesis
+// block, and are then voted in and out by the headers after it, so headers must be
+// verified in order, starting at a checkpoint.
+func NewCliqueVerifier(config *params.CliqueConfig) StatefulSealVerifier {
+	v := &cliqueVerifier{
+		// The database is only needed for voting snapshots, which are kept here instead.
+		c:     clique.New(config, nil),
+		epoch: config.Epoch,
+	}
+	if v.epoch == 0 {
+		v.epoch = cliqueDefaultEpoch
+	}
+	v.Reset()
+	return v
+}
+
+// ReplayFrom returns the checkpoint at or before block n. Who signed the blocks just
+// before the checkpoint isn't known, so a signer who signs again too soon across it
+// isn't caught.
+func (v *cliqueVerifier) ReplayFrom(n uint64) uint64 {
+	return n - n%v.epoch
+}
+
+func (v *cliqueVerifier) Reset() {
+	v.signers = nil
+	v.recents = make(map[uint64]common.Address)
+	v.votes = nil
+	v.tally = make(map[common.Address]cliqueTally)
+}
+
+// checkpointSigners returns the signer list in the extra-data of checkpoint header h.
+func checkpointSigners(h *types.Header) (map[common.Address]bool, error) {
+	list := len(h.Extra) - cliqueExtraVanity - cliqueExtraSeal
+	if list < 0 || list%common.AddressLength != 0 {
+		return nil, fmt.Errorf("checkpoint has bad signer list in extra-data")
+	}
+	signers := make(map[common.Address]bool)
+	for i := 0; i < list/common.AddressLength; i++ {
+		off := cliqueExtraVanity + i*common.AddressLength
+		signers[common.BytesToAddress(h.Extra[off:off+common.AddressLength])] = true
+	}
+	return signers, nil
+}
+
+// cliqueInTurn reports whether it's signer's turn to sign block number, which is when
+// the signer is at position number modulo the number of signers in the sorted list.
+func cliqueInTurn(signers map[common.Address]bool, number uint64, signer common.Address) bool {
+	sorted := make([]common.Address, 0, len(signers))
+	for s := range signers {
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i][:], sorted[j][:]) < 0 })
+	return sorted[number%uint64(len(sorted))] == signer
+}
+
+// checkCliqueHeader makes the checks on h's clique fields, other than its signature, which
+// geth makes in verifyHeader.
+func checkCliqueHeader(h *types.Header, checkpoint bool) error {
+	if len(h.Extra) < cliqueExtraVanity+cliqueExtraSeal {
+		return fmt.Errorf("extra-data is %d bytes, too short for a signature", len(h.Extra))
+	}
+	if !checkpoint && len(h.Extra) != cliqueExtraVanity+cliqueExtraSeal {
+		return fmt.Errorf("extra-data lists signers outside a checkpoint")
+	}
+	if h.Nonce != cliqueNonceAuth && h.Nonce != cliqueNonceDrop {
+		return fmt.Errorf("nonce %x is not a vote", h.Nonce)
+	}
+	if checkpoint && h.Coinbase != (common.Address{}) {
+		return fmt.Errorf("checkpoint votes on %x", h.Coinbase)
+	}
+	if checkpoint && h.Nonce != cliqueNonceDrop {
+		return fmt.Errorf("checkpoint has vote nonce %x", h.Nonce)
+	}
+	return nil
+}
+
+func (v *cliqueVerifier) VerifySeal(h *types.Header) error {
+	number := h.Number.Uint64()
+	checkpoint := number%v.epoch == 0
+	if number == 0 {
+		// The genesis block isn't signed, and just lists the first signers.
+		signers, err := checkpointSigners(h)
+		if err != nil {
+			return err
+		}
+		v.signers = signers
+		return nil
+	}
+	if err := checkCliqueHeader(h, checkpoint); err != nil {
+		return err
+	}
+	var signers map[common.Address]bool
+	if checkpoint {
+		var err error
+		if signers, err = checkpointSigners(h); err != nil {
+			return err
+		}
+		if v.signers != nil && !reflect.DeepEqual(signers, v.signers) {
+			return fmt.Errorf("checkpoint lists %d signers which don't match the %d voted in", len(signers), len(v.signers))
+		}
+	} else if v.signers == nil {
+		return fmt.Errorf("signers at block %d are unknown without the checkpoint before it", number)
+	} else {
+		signers = v.signers
+	}
+
+	signer, err := v.c.Author(h)
+	if err != nil {
+		return err
+	}
+	if !signers[signer] {
+		return fmt.Errorf("signed by %x, which is not an authorised signer", signer)
+	}
+	limit := uint64(len(signers)/2 + 1)
+	for n, r := range v.recents {
+		if r == signer && n+limit > number {
+			return fmt.Errorf("signed by %x, which also signed block %d", signer, n)
+		}
+	}
+	want := cliqueDiffNoTurn
+	if cliqueInTurn(signers, number, signer) {
+		want = cliqueDiffInTurn
+	}
+	if h.Difficulty == nil || h.Difficulty.Cmp(want) != 0 {
+		return fmt.Errorf("difficulty is %v, want %v", h.Difficulty, want)
+	}
+
+	// The header is good, so now it can change who may sign.
+	if checkpoint {
+		// From here on, the checkpoint's signers are known, and votes start again.
+		v.signers = signers
+		v.votes = nil
+		v.tally = make(map[common.Address]cliqueTally)
+	}
+	if number >= limit {
+		delete(v.recents, number-limit)
+	}
+	v.recents[number] = signer
+	if checkpoint {
+		return nil
+	}
+
+	// Discard any earlier vote by the signer on the same account, then count this one.
+	for i, vote := range v.votes {
+		if vote.signer == signer && vote.address == h.Coinbase {
+			v.uncast(vote.address, vote.authorize)
+			v.votes = append(v.votes[:i], v.votes[i+1:]...)
+			break
+		}
+	}
+	authorize := h.Nonce == cliqueNonceAuth
+	if v.cast(h.Coinbase, authorize) {
+		v.votes = append(v.votes, cliqueVote{signer: signer, address: h.Coinbase, authorize: authorize})
+	}
+
+	// A vote passes once a majority of the signers have cast it.
+	if t := v.tally[h.Coinbase]; t.votes > len(v.signers)/2 {
+		if t.authorize {
+			v.signers[h.Coinbase] = true
+		} else {
+			delete(v.signers, h.Coinbase)
+			// The window of recent signers shrinks along with the signer set.
+			if limit := uint64(len(v.signers)/2 + 1); number >= limit {
+				delete(v.recents, number-limit)
+			}
+			// The dropped signer's votes no longer count.
+			for i := 0; i < len(v.votes); i++ {
+				if v.votes[i].signer == h.Coinbase {
+					v.uncast(v.votes[i].address, v.votes[i].authorize)
+					v.votes = append(v.votes[:i], v.votes[i+1:]...)
+					i--
+				}
+			}
+		}
+		// Votes on the account start again from nothing.
+		for i := 0; i < len(v.votes); i++ {
+			if v.votes[i].address == h.Coinbase {
+				v.votes = append(v.votes[:i], v.votes[i+1:]...)
+				i--
+			}
+		}
+		delete(v.tally, h.Coinbase)
+	}
+	return nil
+}
+
+// cast counts a vote to authorise or drop address, and reports whether it counted. A
+// vote to authorise a signer or drop a non-signer doesn't count.
+func (v *cliqueVerifier) cast(address common.Address, authorize bool) bool {
+	if v.signers[address] == authorize {
+		return false
+	}
+	t := v.tally[address]
+	t.authorize = authorize
+	t.votes++
+	v.tally[address] = t
+	return true
+}
+
+// uncast takes back a vote counted by cast.
+func (v *cliqueVerifier) uncast(address common.Address, authorize bool) {
+	t, ok := v.tally[address]
+	if !ok || t.authorize != authorize {
+		return
+	}
+	if t.votes > 1 {
+		t.votes--
+		v.tally[address] = t
+	} else {
+		delete(v.tally, address)
+	}
+}
+
+// replaySeals gives a StatefulSealVerifier the headers from the log which it needs in
+// order to verify block next, unless it has just verified the block before.
+func (f *Follower) replaySeals(ctx context.Context, next int64) error {
+	sv, ok := f.opts.SealVerifier.(StatefulSealVerifier)
+	if !ok || next == f.sealNext {
+		return nil
+	}
+	f.sealNext = -1
+	sv.Reset()
+	from := int64(sv.ReplayFrom(uint64(next)))
+	if from < next {
+		glog.Infof("Verifying seals of blocks [%d, %d) from the log", from, next)
+	}
+	for start := from; start < next; start += confirmChunk {
+		end := start + confirmChunk
+		if end > next {
+			end = next
+		}
+		idx := make([]int64, 0, end-start)
+		for i := start; i < end; i++ {
+			idx = append(idx, i)
+		}
+		rsp, err := f.tc.GetLeavesByIndex(ctx, &trillian.GetLeavesByIndexRequest{LogId: f.logID, LeafIndex: idx})
+		if err != nil {
+			return err
+		}
+		got := make(map[int64][]byte)
+		for _, l := range rsp.Leaves {
+			got[l.LeafIndex] = l.LeafValue
+		}
+		for _, i := range idx {
+			v, ok := got[i]
+			if !ok {
+				return fmt.Errorf("log did not return block %d", i)
+			}
+			l, err := blockleaf.Decode(v)
+			if err != nil {
+				return fmt.Errorf("failed to decode block %d from log: %v", i, err)
+			}
+			if err := sv.VerifySeal(l.BlockHeader()); err != nil {
+				return &SealError{Number: i, Err: err}
+			}
+		}
+	}
+	f.sealNext = next
+	return nil
+}
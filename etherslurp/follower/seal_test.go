@@ -0,0 +1,426 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package follower
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+	"github.com/google/trillian-examples/etherslurp/testonly"
+)
+
+// cliqueSigners are keys for signing clique headers in tests, referred to by their
+// position.
+type cliqueSigners struct {
+	t    *testing.T
+	keys []*ecdsa.PrivateKey
+}
+
+func newCliqueSigners(t *testing.T, n int) *cliqueSigners {
+	t.Helper()
+	s := &cliqueSigners{t: t}
+	for i := 0; i < n; i++ {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.keys = append(s.keys, key)
+	}
+	return s
+}
+
+func (s *cliqueSigners) addr(i int) common.Address {
+	return crypto.PubkeyToAddress(s.keys[i].PublicKey)
+}
+
+// extra returns extra-data listing the given signers, with room for a seal.
+func (s *cliqueSigners) extra(signers []int) []byte {
+	extra := make([]byte, cliqueExtraVanity)
+	for _, i := range signers {
+		extra = append(extra, s.addr(i).Bytes()...)
+	}
+	return append(extra, make([]byte, cliqueExtraSeal)...)
+}
+
+// sign seals h with the key of signer i, as clique does.
+func (s *cliqueSigners) sign(h *types.Header, i int) {
+	s.t.Helper()
+	enc, err := rlp.EncodeToBytes([]interface{}{
+		h.ParentHash, h.UncleHash, h.Coinbase, h.Root, h.TxHash, h.ReceiptHash, h.Bloom, h.Difficulty,
+		h.Number, h.GasLimit, h.GasUsed, h.Time, h.Extra[:len(h.Extra)-cliqueExtraSeal], h.MixDigest, h.Nonce,
+	})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	sig, err := crypto.Sign(crypto.Keccak256(enc), s.keys[i])
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	copy(h.Extra[len(h.Extra)-cliqueExtraSeal:], sig)
+}
+
+// cliqueStep is a header signed by signer. If voted isn't negative, the header votes
+// to authorise that signer or drop it. If checkpoint isn't nil, the header lists
+// those signers.
+type cliqueStep struct {
+	signer     int
+	voted      int
+	authorize  bool
+	checkpoint []int
+	// wrongDiff gives the header the wrong difficulty, and badNonce a nonce that isn't
+	// a vote.
+	wrongDiff bool
+	badNonce  bool
+}
+
+// header returns the header for step at block number, given that v has verified the
+// headers before it.
+func (s *cliqueSigners) header(v *cliqueVerifier, number uint64, step cliqueStep) *types.Header {
+	s.t.Helper()
+	h := testonly.Header(number)
+	h.Extra = s.extra(step.checkpoint)
+	if step.voted >= 0 {
+		h.Coinbase = s.addr(step.voted)
+		if step.authorize {
+			h.Nonce = cliqueNonceAuth
+		}
+	}
+	if step.badNonce {
+		h.Nonce = types.BlockNonce{1}
+	}
+	h.Difficulty = new(big.Int).Set(cliqueDiffNoTurn)
+	if v.signers != nil && cliqueInTurn(v.signers, number, s.addr(step.signer)) {
+		h.Difficulty.Set(cliqueDiffInTurn)
+	}
+	if step.wrongDiff {
+		h.Difficulty.Add(h.Difficulty, big.NewInt(1))
+	}
+	s.sign(h, step.signer)
+	return h
+}
+
+func (s *cliqueSigners) genesis(signers []int) *types.Header {
+	h := testonly.Header(0)
+	h.Extra = s.extra(signers)
+	return h
+}
+
+// signed is a step in which signer signs a header that doesn't vote.
+func signed(signer int) cliqueStep {
+	return cliqueStep{signer: signer, voted: -1}
+}
+
+// vote is a step in which signer votes on voted.
+func vote(signer, voted int, authorize bool) cliqueStep {
+	return cliqueStep{signer: signer, voted: voted, authorize: authorize}
+}
+
+// checkpoint is a step in which signer signs a checkpoint listing signers.
+func checkpoint(signer int, signers ...int) cliqueStep {
+	return cliqueStep{signer: signer, voted: -1, checkpoint: signers}
+}
+
+func TestCliqueVerifier(t *testing.T) {
+	const a, b, c, d = 0, 1, 2, 3
+	for _, tc := range []struct {
+		desc    string
+		epoch   uint64
+		genesis []int
+		steps   []cliqueStep
+		// wantErr is whether the last step fails. want is the signers afterwards.
+		wantErr bool
+		want    []int
+	}{
+		{
+			desc:    "single signer",
+			genesis: []int{a},
+			steps:   []cliqueStep{signed(a), signed(a)},
+			want:    []int{a},
+		},
+		{
+			desc:    "authorise with one vote of one",
+			genesis: []int{a},
+			steps:   []cliqueStep{vote(a, b, true)},
+			want:    []int{a, b},
+		},
+		{
+			desc:    "one vote of two isn't a majority",
+			genesis: []int{a, b},
+			steps:   []cliqueStep{vote(a, c, true)},
+			want:    []int{a, b},
+		},
+		{
+			desc:    "authorise with two votes of two",
+			genesis: []int{a, b},
+			steps:   []cliqueStep{vote(a, c, true), vote(b, c, true)},
+			want:    []int{a, b, c},
+		},
+		{
+			desc:    "drop with two votes of three",
+			genesis: []int{a, b, c},
+			steps:   []cliqueStep{vote(a, c, false), vote(b, c, false)},
+			want:    []int{a, b},
+		},
+		{
+			desc:    "voting twice counts once",
+			genesis: []int{a, b, c},
+			steps:   []cliqueStep{vote(a, d, true), signed(b), vote(a, d, true)},
+			want:    []int{a, b, c},
+		},
+		{
+			desc:    "changed vote is discarded",
+			genesis: []int{a, b, c},
+			steps:   []cliqueStep{vote(a, d, true), signed(b), vote(a, d, false), vote(c, d, true)},
+			want:    []int{a, b, c},
+		},
+		{
+			desc:    "authorising a signer doesn't count",
+			genesis: []int{a, b},
+			steps:   []cliqueStep{vote(a, b, true), vote(b, a, true)},
+			want:    []int{a, b},
+		},
+		{
+			desc:    "dropped signer's votes are discarded",
+			genesis: []int{a, b, c, d},
+			// c votes for b to go, then c is dropped by a, b and d, leaving b's
+			// drop with one vote of three.
+			steps: []cliqueStep{vote(c, b, false), vote(a, c, false), vote(b, c, false), vote(d, c, false), vote(a, b, false)},
+			want:  []int{a, b, d},
+		},
+		{
+			desc:    "unauthorised signer",
+			genesis: []int{a},
+			steps:   []cliqueStep{signed(b)},
+			wantErr: true,
+		},
+		{
+			desc:    "signed within the recent window",
+			genesis: []int{a, b},
+			steps:   []cliqueStep{signed(a), signed(a)},
+			wantErr: true,
+		},
+		{
+			desc:    "signed after the recent window",
+			genesis: []int{a, b, c},
+			steps:   []cliqueStep{signed(a), signed(b), signed(a)},
+			want:    []int{a, b, c},
+		},
+		{
+			desc:    "dropped signer can't sign",
+			genesis: []int{a, b},
+			steps:   []cliqueStep{vote(a, b, false), vote(b, b, false), signed(b)},
+			wantErr: true,
+		},
+		{
+			desc:    "wrong difficulty",
+			genesis: []int{a, b},
+			steps:   []cliqueStep{{signer: a, voted: -1, wrongDiff: true}},
+			wantErr: true,
+		},
+		{
+			desc:    "nonce isn't a vote",
+			genesis: []int{a},
+			steps:   []cliqueStep{{signer: a, voted: -1, badNonce: true}},
+			wantErr: true,
+		},
+		{
+			desc:    "signers listed outside a checkpoint",
+			genesis: []int{a},
+			steps:   []cliqueStep{checkpoint(a, a)},
+			wantErr: true,
+		},
+		{
+			desc:    "checkpoint matches",
+			epoch:   3,
+			genesis: []int{a, b},
+			steps:   []cliqueStep{vote(a, c, true), vote(b, c, true), checkpoint(a, a, b, c), signed(c)},
+			want:    []int{a, b, c},
+		},
+		{
+			desc:    "checkpoint doesn't match",
+			epoch:   2,
+			genesis: []int{a, b},
+			steps:   []cliqueStep{signed(a), checkpoint(b, a)},
+			wantErr: true,
+		},
+		{
+			desc:    "checkpoint votes",
+			epoch:   2,
+			genesis: []int{a, b},
+			steps:   []cliqueStep{signed(a), {signer: b, voted: c, authorize: true, checkpoint: []int{a, b}}},
+			wantErr: true,
+		},
+		{
+			desc:    "checkpoint resets votes",
+			epoch:   3,
+			genesis: []int{a, b},
+			steps:   []cliqueStep{vote(a, c, true), signed(b), checkpoint(a, a, b), vote(b, c, true)},
+			want:    []int{a, b},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			s := newCliqueSigners(t, 4)
+			v := NewCliqueVerifier(&params.CliqueConfig{Period: 15, Epoch: tc.epoch}).(*cliqueVerifier)
+			if err := v.VerifySeal(s.genesis(tc.genesis)); err != nil {
+				t.Fatalf("VerifySeal(genesis): %v", err)
+			}
+			for i, step := range tc.steps {
+				num := uint64(i + 1)
+				err := v.VerifySeal(s.header(v, num, step))
+				if last := i == len(tc.steps)-1; last && tc.wantErr {
+					if err == nil {
+						t.Fatalf("VerifySeal(%d): no error", num)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("VerifySeal(%d): %v", num, err)
+				}
+			}
+			if len(v.signers) != len(tc.want) {
+				t.Errorf("Got %d signers, want %d", len(v.signers), len(tc.want))
+			}
+			for _, i := range tc.want {
+				if !v.signers[s.addr(i)] {
+					t.Errorf("Signer %d isn't authorised", i)
+				}
+			}
+		})
+	}
+}
+
+func TestReplaySeals(t *testing.T) {
+	const a, b, c = 0, 1, 2
+	ctx := context.Background()
+	s := newCliqueSigners(t, 3)
+	config := &params.CliqueConfig{Period: 15, Epoch: 4}
+
+	// b is voted in at block 1, which the checkpoint at block 4 records.
+	v := NewCliqueVerifier(config).(*cliqueVerifier)
+	headers := []*types.Header{s.genesis([]int{a})}
+	for i, step := range []cliqueStep{vote(a, b, true), signed(b), signed(a), checkpoint(b, a, b), signed(a)} {
+		if err := v.VerifySeal(headers[len(headers)-1]); err != nil {
+			t.Fatalf("VerifySeal(%d): %v", i, err)
+		}
+		headers = append(headers, s.header(v, uint64(i+1), step))
+	}
+	if err := v.VerifySeal(headers[len(headers)-1]); err != nil {
+		t.Fatalf("VerifySeal(%d): %v", len(headers)-1, err)
+	}
+
+	// Only the blocks from the checkpoint are in the log, which is all a restarted
+	// Follower should need.
+	newFollower := func(headers []*types.Header) (*Follower, *cliqueVerifier) {
+		tl := newFakeLog()
+		for i := 4; i < len(headers); i++ {
+			raw, err := blockleaf.Encode(&blockleaf.Leaf{Version: blockleaf.VersionBlock, Block: types.NewBlockWithHeader(headers[i])})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tl.leaves[int64(i)] = raw
+		}
+		v := NewCliqueVerifier(config).(*cliqueVerifier)
+		return New(nil, tl, 1, Opts{SealVerifier: v}), v
+	}
+
+	f, rv := newFollower(headers)
+	if err := f.replaySeals(ctx, 6); err != nil {
+		t.Fatalf("replaySeals(): %v", err)
+	}
+	if f.sealNext != 6 {
+		t.Errorf("After replaySeals(), sealNext = %d, want 6", f.sealNext)
+	}
+	// a signed block 5, so may not sign block 6, but b may.
+	if err := rv.VerifySeal(s.header(rv, 6, signed(a))); err == nil {
+		t.Error("VerifySeal() of block signed again by a: no error")
+	}
+	if err := rv.VerifySeal(s.header(rv, 6, signed(b))); err != nil {
+		t.Errorf("VerifySeal() of block signed by b: %v", err)
+	}
+
+	// A block in the log signed by someone who isn't a signer stops the replay.
+	bad := append([]*types.Header{}, headers...)
+	bad[5] = s.header(rv, 5, signed(c))
+	f, _ = newFollower(bad)
+	err := f.replaySeals(ctx, 6)
+	if se, ok := err.(*SealError); !ok || se.Number != 5 {
+		t.Errorf("replaySeals() with a bad block = %v, want *SealError at block 5", err)
+	}
+	if f.sealNext != -1 {
+		t.Errorf("After failed replaySeals(), sealNext = %d, want -1", f.sealNext)
+	}
+}
+
+func TestEthashVerifier(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Building the ethash cache takes a while")
+	}
+	dir, err := ioutil.TempDir("", "ethash_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	v := NewEthashVerifier(dir)
+
+	// Block 1 of mainnet.
+	h := &types.Header{
+		ParentHash:  common.HexToHash("0xd4e56740f876aef8c010b86a40d5f56745a118d0906a34e69aec8c0db1cb8fa3"),
+		UncleHash:   types.EmptyUncleHash,
+		Coinbase:    common.HexToAddress("0x05a56e2d52c817161883f50c441c3228cfe54d9f"),
+		Root:        common.HexToHash("0xd67e4d450343046425ae4271474353857ab860dbc0a1dde64b41b5cd3a532bf3"),
+		TxHash:      types.EmptyRootHash,
+		ReceiptHash: types.EmptyRootHash,
+		Difficulty:  big.NewInt(17171480576),
+		Number:      big.NewInt(1),
+		GasLimit:    5000,
+		Time:        big.NewInt(1438269988),
+		Extra:       hexutil.MustDecode("0x476574682f76312e302e302f6c696e75782f676f312e342e32"),
+		MixDigest:   common.HexToHash("0x969b900de27b6ac6a67742365dd65f55a0526c41fd18e1b16f1a1215c2e66f59"),
+		Nonce:       types.EncodeNonce(0x539bd4979fef1ec4),
+	}
+	if got, want := h.Hash(), common.HexToHash("0x88e96d4537bea4d9c05d12549907b32561d3bf31f45aae734cdc119f13406cb6"); got != want {
+		t.Fatalf("Test header has hash %x, want %x", got, want)
+	}
+	if err := v.VerifySeal(h); err != nil {
+		t.Errorf("VerifySeal(): %v", err)
+	}
+
+	for _, tc := range []struct {
+		desc   string
+		change func(h *types.Header)
+	}{
+		{desc: "nonce", change: func(h *types.Header) { h.Nonce = types.EncodeNonce(h.Nonce.Uint64() + 1) }},
+		{desc: "mix digest", change: func(h *types.Header) { h.MixDigest[0] ^= 1 }},
+		{desc: "difficulty", change: func(h *types.Header) { h.Difficulty = new(big.Int).Lsh(h.Difficulty, 8) }},
+		{desc: "contents", change: func(h *types.Header) { h.Coinbase = common.Address{} }},
+	} {
+		bad := types.CopyHeader(h)
+		tc.change(bad)
+		if err := v.VerifySeal(bad); err == nil {
+			t.Errorf("VerifySeal() with changed %s: no error", tc.desc)
+		}
+	}
+}
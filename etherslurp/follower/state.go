@@ -0,0 +1,233 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package follower
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/golang/glog"
+	"github.com/google/trillian"
+	ttypes "github.com/google/trillian/types"
+)
+
+// confirmChunk is the maximum number of leaves fetched at once when confirming that
+// blocks have been integrated.
+const confirmChunk = 100
+
+// State is the Follower's record of its progress, which is kept in Opts.StateFile.
+type State struct {
+	// Block is the highest block which, along with every block before it, is known to
+	// have been integrated into the log, or -1 if there is none.
+	Block int64
+	// Hash is the hash of Block.
+	Hash common.Hash
+}
+
+// Status describes what the Follower is doing. It's served as JSON by ServeHTTP.
+type Status struct {
+	// NextBlock is the next block to be added to the log.
+	NextBlock int64
+	// Confirmed is the Follower's progress in integrating blocks.
+	Confirmed State
+	// TreeSize is the size of the latest log root.
+	TreeSize uint64
+	// Head is the latest block available from the source.
+	Head uint64
+	// Added is the number of blocks added to the log since the Follower started.
+	Added           uint64
+	BlocksPerSecond float64
+}
+
+// pendingLeaf is a block which has been added to the log, but hasn't yet been seen to
+// be integrated.
+type pendingLeaf struct {
+	index     int64
+	leafHash  [sha256.Size]byte
+	blockHash common.Hash
+}
+
+// loadState reads the Follower's state from Opts.StateFile, if it exists.
+func (f *Follower) loadState() error {
+	s := State{Block: -1}
+	if f.opts.StateFile != "" {
+		j, err := ioutil.ReadFile(f.opts.StateFile)
+		if err == nil {
+			if err := json.Unmarshal(j, &s); err != nil {
+				return fmt.Errorf("failed to parse state file %s: %v", f.opts.StateFile, err)
+			}
+			glog.Infof("Loaded state, confirmed up to block %d", s.Block)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	f.mu.Lock()
+	f.status.Confirmed = s
+	f.mu.Unlock()
+	return nil
+}
+
+// setConfirmed records that blocks up to and including block have been integrated,
+// and saves that to Opts.StateFile if it's set.
+func (f *Follower) setConfirmed(block int64, hash common.Hash) error {
+	s := State{Block: block, Hash: hash}
+	f.mu.Lock()
+	f.status.Confirmed = s
+	f.mu.Unlock()
+
+	if f.opts.StateFile == "" {
+		return nil
+	}
+	j, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	// Write then rename, so a crash never leaves a partial state file.
+	tmp := f.opts.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, j, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.opts.StateFile)
+}
+
+// reconcile checks the state loaded at startup against the log, whose latest root is
+// root, and returns the block to resume from and the hash of the block before it.
+// The state is the resume point, so blocks which were added but not confirmed before
+// a restart are added again, and checked against what the log holds when they're
+// confirmed. If there's no state, every block in the log is taken to be confirmed.
+func (f *Follower) reconcile(ctx context.Context, root *ttypes.LogRootV1) (int64, common.Hash, error) {
+	size := int64(root.TreeSize)
+	f.mu.Lock()
+	s := f.status.Confirmed
+	f.mu.Unlock()
+	if s.Block >= size {
+		return 0, common.Hash{}, f.integrityFailure(fmt.Errorf("log has %d blocks, but block %d was already confirmed", size, s.Block))
+	}
+	if s.Block >= 0 {
+		h, err := f.loggedHash(ctx, s.Block)
+		if err != nil {
+			return 0, common.Hash{}, err
+		}
+		if h != s.Hash {
+			return 0, common.Hash{}, f.integrityFailure(fmt.Errorf("block %d in log has hash %x, but %x was confirmed", s.Block, h, s.Hash))
+		}
+		return s.Block + 1, s.Hash, nil
+	}
+	if size == 0 {
+		return 0, common.Hash{}, nil
+	}
+
+	// The log only integrates contiguous leaves, so its size is the first block which
+	// is missing, even if later blocks have been added.
+	glog.Warningf("No state, taking the %d blocks in the log to be confirmed", size)
+	h, err := f.loggedHash(ctx, size-1)
+	if err != nil {
+		return 0, common.Hash{}, fmt.Errorf("failed to get last block in log: %v", err)
+	}
+	return size, h, f.setConfirmed(size-1, h)
+}
+
+// waitForPending waits until fewer than Opts.MaxPending blocks are waiting to be
+// confirmed, so that the Follower's memory use is bounded when the log falls behind.
+func (f *Follower) waitForPending(ctx context.Context) error {
+	for len(f.pending) >= f.opts.MaxPending {
+		root, err := f.updateRoot(ctx)
+		if err == nil {
+			err = f.confirm(ctx, root)
+		}
+		if _, ok := err.(*IntegrityError); ok {
+			return err
+		} else if err != nil {
+			glog.Warningf("Failed to confirm blocks: %v", err)
+		}
+		if len(f.pending) < f.opts.MaxPending {
+			break
+		}
+		glog.V(1).Infof("Waiting for the log to integrate %d blocks", len(f.pending))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return nil
+}
+
+// confirm checks that the pending blocks which the log root says have been integrated
+// are the ones that the Follower added, and advances the confirmed state past them.
+func (f *Follower) confirm(ctx context.Context, root *ttypes.LogRootV1) error {
+	n := 0
+	for n < len(f.pending) && f.pending[n].index < int64(root.TreeSize) {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	for start := 0; start < n; start += confirmChunk {
+		end := start + confirmChunk
+		if end > n {
+			end = n
+		}
+		idx := make([]int64, 0, end-start)
+		for _, p := range f.pending[start:end] {
+			idx = append(idx, p.index)
+		}
+		rsp, err := f.tc.GetLeavesByIndex(ctx, &trillian.GetLeavesByIndexRequest{LogId: f.logID, LeafIndex: idx})
+		if err != nil {
+			return err
+		}
+		got := make(map[int64][]byte)
+		for _, l := range rsp.Leaves {
+			got[l.LeafIndex] = l.LeafValue
+		}
+		for _, p := range f.pending[start:end] {
+			v, ok := got[p.index]
+			if !ok {
+				return fmt.Errorf("log did not return block %d", p.index)
+			}
+			if sha256.Sum256(v) != p.leafHash {
+				return f.integrityFailure(fmt.Errorf("log has a different block %d to the one added", p.index))
+			}
+		}
+	}
+
+	last := f.pending[n-1]
+	f.pending = f.pending[n:]
+	return f.setConfirmed(last.index, last.blockHash)
+}
+
+// ServeHTTP serves the Follower's Status as JSON.
+func (f *Follower) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	s := f.status
+	started := f.started
+	f.mu.Unlock()
+	if !started.IsZero() {
+		s.BlocksPerSecond = float64(s.Added) / time.Since(started).Seconds()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		glog.Errorf("Failed to write status: %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/golang/glog"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+	"github.com/google/trillian-examples/etherslurp/chain"
+	"github.com/google/trillian-examples/etherslurp/source"
+)
+
+// Balances is a MapFunction which maps the sha256 hash of each account's address to its
+// balance in wei, as a decimal string. It also records the creation of each contract.
+type Balances struct {
+	network  *chain.Network
+	receipts source.ReceiptSource
+
+	// changes holds the deltas and contracts of the last block seen, as Indices and Map
+	// are called for the same block in turn.
+	changes *blockChanges
+}
+
+// blockChanges is what a block changes in the map built by Balances.
+type blockChanges struct {
+	hash      common.Hash
+	deltas    map[string]*big.Int
+	contracts map[common.Address]*Contract
+}
+
+// NewBalances creates a Balances for the given network. Receipts, if not nil, is where
+// the receipts for transactions are fetched from when the log doesn't hold them.
+func NewBalances(network *chain.Network, receipts source.ReceiptSource) *Balances {
+	return &Balances{network: network, receipts: receipts}
+}
+
+// Contract is the value of the map leaf recording the creation of a contract.
+type Contract struct {
+	Creator common.Address
+	Block   int64
+	TxHash  common.Hash
+}
+
+// contractIndex returns the index of the leaf recording the creation of contract a,
+// which is kept apart from a's balance leaf by a prefix.
+func contractIndex(a common.Address) string {
+	return Index(append([]byte("contract:"), a.Bytes()...))
+}
+
+// addDelta adds v to the delta for account a.
+func addDelta(deltas map[string]*big.Int, a common.Address, v *big.Int) {
+	i := Index(a.Bytes())
+	if d, ok := deltas[i]; ok {
+		d.Add(d, v)
+	} else {
+		deltas[i] = new(big.Int).Set(v)
+	}
+}
+
+// failed reports whether the transaction with receipt r failed. Receipts from before
+// Byzantium hold a state root rather than a status, and such transactions are taken
+// to have succeeded.
+func failed(r *types.Receipt) bool {
+	return len(r.PostState) == 0 && r.Status == types.ReceiptStatusFailed
+}
+
+// receiptsFor returns the receipts for the transactions in the block in l, which are
+// fetched from the receipt source if the log didn't hold them.
+func (bl *Balances) receiptsFor(ctx context.Context, l *blockleaf.Leaf) ([]*types.Receipt, error) {
+	txs := l.Block.Transactions()
+	if l.Receipts != nil || len(txs) == 0 {
+		return l.Receipts, nil
+	}
+	if bl.receipts == nil {
+		return nil, fmt.Errorf("no receipts for block %v in log, and no receipt source", l.Block.Number())
+	}
+	rs := make([]*types.Receipt, 0, len(txs))
+	for _, tx := range txs {
+		r, err := bl.receipts.TransactionReceipt(ctx, tx.Hash())
+		if err != nil {
+			return nil, &FetchError{Err: fmt.Errorf("failed to get receipt for tx %x: %v", tx.Hash(), err)}
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// deltas returns the changes made to balances by the block in l, and the contracts it
+// created. They're worked out once for each block.
+func (bl *Balances) deltas(ctx context.Context, l *blockleaf.Leaf) (map[string]*big.Int, map[common.Address]*Contract, error) {
+	if c := bl.changes; c != nil && c.hash == l.Block.Hash() {
+		return c.deltas, c.contracts, nil
+	}
+	b := l.Block
+	deltas := make(map[string]*big.Int)
+	contracts := make(map[common.Address]*Contract)
+
+	// Add block rewards, which are due even if there are no transactions.
+	for a, r := range blockRewards(bl.network.Config, b) {
+		glog.V(1).Infof("Miner credit for %s...: %s", fmtAddress(a.Bytes())[:5], ethBalance(r))
+		addDelta(deltas, a, r)
+	}
+
+	receipts, err := bl.receiptsFor(ctx, l)
+	if err != nil {
+		return nil, nil, err
+	}
+	if got, want := len(receipts), len(b.Transactions()); got != want {
+		return nil, nil, fmt.Errorf("got %d receipts for %d transactions in block %v", got, want, b.Number())
+	}
+	txSenders, err := senders(bl.network, b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, tx := range b.Transactions() {
+		from := txSenders[i]
+
+		// The sender pays for the gas actually used, which goes to the miner.
+		r := receipts[i]
+		fee := new(big.Int).Mul(new(big.Int).SetUint64(r.GasUsed), tx.GasPrice())
+		addDelta(deltas, from, new(big.Int).Neg(fee))
+		addDelta(deltas, b.Coinbase(), fee)
+
+		if failed(r) {
+			glog.V(1).Infof("TX %d@%v failed, only charging fee of %s", i, b.Number(), ethBalance(fee))
+			continue
+		}
+
+		to := tx.To()
+		if to == nil {
+			addr := r.ContractAddress
+			if addr == (common.Address{}) {
+				addr = crypto.CreateAddress(from, tx.Nonce())
+			}
+			glog.V(1).Infof("TX %d@%v created contract %s...", i, b.Number(), fmtAddress(addr.Bytes())[:5])
+			contracts[addr] = &Contract{Creator: from, Block: b.Number().Int64(), TxHash: tx.Hash()}
+			to = &addr
+		}
+		addDelta(deltas, from, new(big.Int).Neg(tx.Value()))
+		addDelta(deltas, *to, tx.Value())
+
+		{
+			// only using floats for printing, map should use the fixed point representation!
+			sender := fmtAddress(from.Bytes())
+			recipient := fmtAddress(to.Bytes())
+			glog.V(1).Infof("%s from %s... -> %s..., costing %s", ethBalance(tx.Value()), sender[:5], recipient[:5], ethBalance(fee))
+		}
+	}
+	bl.changes = &blockChanges{hash: b.Hash(), deltas: deltas, contracts: contracts}
+	return deltas, contracts, nil
+}
+
+// Indices returns the balance leaves of the accounts touched by the block in l.
+func (bl *Balances) Indices(ctx context.Context, l *blockleaf.Leaf) ([]string, error) {
+	deltas, _, err := bl.deltas(ctx, l)
+	if err != nil {
+		return nil, err
+	}
+	indices := make([]string, 0, len(deltas))
+	for k := range deltas {
+		indices = append(indices, k)
+	}
+	return indices, nil
+}
+
+// Map applies the changes made by the block in l to the balances in leaves. It returns
+// a *CorruptLeafError for a leaf that doesn't hold a balance.
+func (bl *Balances) Map(ctx context.Context, l *blockleaf.Leaf, leaves map[string][]byte) (map[string][]byte, error) {
+	deltas, contracts, err := bl.deltas(ctx, l)
+	if err != nil {
+		return nil, err
+	}
+	num := l.Block.Number().Int64()
+	glog.Infof("Mapping %d transactions from block @ %d, changing %d balances", len(l.Block.Transactions()), num, len(deltas))
+
+	updates := make(map[string][]byte)
+	for k, d := range deltas {
+		v := leaves[k]
+		bal := big.NewInt(0)
+		if len(v) > 0 {
+			if _, ok := bal.SetString(string(v), 10); !ok {
+				return nil, &CorruptLeafError{Index: []byte(k), Value: v}
+			}
+		}
+		glog.V(1).Infof("index %x... had: %s", k[:5], ethBalance(bal))
+		bal.Add(bal, d)
+		updates[k] = []byte(bal.String())
+		glog.V(1).Infof("index %x... now has: %s", k[:5], ethBalance(bal))
+	}
+
+	for a, c := range contracts {
+		v, err := json.Marshal(c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal contract %x: %v", a, err)
+		}
+		updates[contractIndex(a)] = v
+	}
+	return updates, nil
+}
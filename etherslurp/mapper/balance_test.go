@@ -0,0 +1,408 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+	"github.com/google/trillian-examples/etherslurp/chain"
+	"github.com/google/trillian-examples/etherslurp/testonly"
+)
+
+var testNetwork = chain.Networks["mainnet"]
+
+func testKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testBlock returns block num, mined by coinbase, holding txs signed by key.
+func testBlock(t *testing.T, num uint64, coinbase common.Address, key *ecdsa.PrivateKey, txs ...*types.Transaction) *types.Block {
+	t.Helper()
+	h := testonly.Header(num)
+	h.Coinbase = coinbase
+	b, err := testonly.Block(testNetwork.Config, h, key, txs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// fakeReceipts serves receipts by transaction hash, and counts how often it's asked.
+type fakeReceipts struct {
+	receipts map[common.Hash]*types.Receipt
+	calls    int
+	err      error
+}
+
+func (f *fakeReceipts) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	r, ok := f.receipts[txHash]
+	if !ok {
+		return nil, fmt.Errorf("no receipt for %x", txHash)
+	}
+	return r, nil
+}
+
+// balanceBlock is a block on mainnet's Frontier rules paying the block reward to miner,
+// in which sender pays 100 wei to recipient, creates a contract with 10 wei, and fails
+// to pay recipient 1000 wei. Each transaction has a gas price of 2.
+type balanceBlock struct {
+	block                       *types.Block
+	receipts                    []*types.Receipt
+	miner, sender, recipient    common.Address
+	contract                    common.Address
+	minerDelta, senderDelta     *big.Int
+	recipientDelta, contractVal *big.Int
+}
+
+func newBalanceBlock(t *testing.T) *balanceBlock {
+	t.Helper()
+	key := testKey(t)
+	bb := &balanceBlock{
+		miner:     common.BigToAddress(big.NewInt(1)),
+		sender:    crypto.PubkeyToAddress(key.PublicKey),
+		recipient: common.BigToAddress(big.NewInt(2)),
+	}
+	bb.contract = crypto.CreateAddress(bb.sender, 1)
+	gasPrice := big.NewInt(2)
+	bb.block = testBlock(t, 1, bb.miner, key,
+		types.NewTransaction(0, bb.recipient, big.NewInt(100), 21000, gasPrice, nil),
+		types.NewContractCreation(1, big.NewInt(10), 100000, gasPrice, []byte{0}),
+		types.NewTransaction(2, bb.recipient, big.NewInt(1000), 21000, gasPrice, nil))
+	bb.receipts = []*types.Receipt{
+		{Status: types.ReceiptStatusSuccessful, GasUsed: 21000},
+		{Status: types.ReceiptStatusSuccessful, GasUsed: 50000},
+		{Status: types.ReceiptStatusFailed, GasUsed: 21000},
+	}
+
+	fees := big.NewInt(2 * (21000 + 50000 + 21000))
+	bb.minerDelta = new(big.Int).Add(frontierReward, fees)
+	bb.senderDelta = new(big.Int).Neg(new(big.Int).Add(fees, big.NewInt(110)))
+	bb.recipientDelta = big.NewInt(100)
+	bb.contractVal = big.NewInt(10)
+	return bb
+}
+
+// sum returns the decimal string of v + d.
+func sum(v int64, d *big.Int) string {
+	return new(big.Int).Add(big.NewInt(v), d).String()
+}
+
+func TestBalances(t *testing.T) {
+	ctx := context.Background()
+	bb := newBalanceBlock(t)
+	leaves := map[string][]byte{
+		Index(bb.sender.Bytes()): []byte("1000000"),
+		Index(bb.miner.Bytes()):  []byte("7"),
+	}
+	want := map[string]string{
+		Index(bb.sender.Bytes()):    sum(1000000, bb.senderDelta),
+		Index(bb.miner.Bytes()):     sum(7, bb.minerDelta),
+		Index(bb.recipient.Bytes()): sum(0, bb.recipientDelta),
+		Index(bb.contract.Bytes()):  sum(0, bb.contractVal),
+	}
+
+	for _, inLog := range []bool{true, false} {
+		t.Run(fmt.Sprintf("receipts in log %v", inLog), func(t *testing.T) {
+			l := &blockleaf.Leaf{Version: blockleaf.VersionBlock, Block: bb.block}
+			src := &fakeReceipts{receipts: make(map[common.Hash]*types.Receipt)}
+			if inLog {
+				l.Receipts = bb.receipts
+			} else {
+				for i, tx := range bb.block.Transactions() {
+					src.receipts[tx.Hash()] = bb.receipts[i]
+				}
+			}
+			bl := NewBalances(testNetwork, src)
+
+			indices, err := bl.Indices(ctx, l)
+			if err != nil {
+				t.Fatalf("Indices(): %v", err)
+			}
+			if len(indices) != len(want) {
+				t.Errorf("Indices() returned %d indices, want %d", len(indices), len(want))
+			}
+			for _, i := range indices {
+				if _, ok := want[i]; !ok {
+					t.Errorf("Indices() returned unexpected index %x", i)
+				}
+			}
+
+			updates, err := bl.Map(ctx, l, leaves)
+			if err != nil {
+				t.Fatalf("Map(): %v", err)
+			}
+			for k, v := range want {
+				if got := string(updates[k]); got != v {
+					t.Errorf("Map() set %x to %q, want %q", k, got, v)
+				}
+			}
+			var c Contract
+			if err := json.Unmarshal(updates[contractIndex(bb.contract)], &c); err != nil {
+				t.Fatalf("Failed to parse contract leaf: %v", err)
+			}
+			if want := (Contract{Creator: bb.sender, Block: 1, TxHash: bb.block.Transactions()[1].Hash()}); c != want {
+				t.Errorf("Map() recorded contract %+v, want %+v", c, want)
+			}
+			if got, want := len(updates), len(want)+1; got != want {
+				t.Errorf("Map() returned %d leaves, want %d", got, want)
+			}
+
+			// Receipts are fetched once for both calls, and aren't put in the
+			// shared leaf.
+			if want := 3; !inLog && src.calls != want {
+				t.Errorf("Fetched %d receipts, want %d", src.calls, want)
+			}
+			if !inLog && l.Receipts != nil {
+				t.Error("Balances filled in the leaf's receipts")
+			}
+		})
+	}
+}
+
+func TestBalancesErrors(t *testing.T) {
+	ctx := context.Background()
+	bb := newBalanceBlock(t)
+	l := &blockleaf.Leaf{Version: blockleaf.VersionBlock, Block: bb.block}
+
+	bl := NewBalances(testNetwork, &fakeReceipts{err: errors.New("geth is down")})
+	if _, err := bl.Indices(ctx, l); err == nil {
+		t.Error("Indices() with no receipts: no error")
+	} else if _, ok := err.(*FetchError); !ok {
+		t.Errorf("Indices() = %v, want *FetchError", err)
+	}
+
+	if _, err := NewBalances(testNetwork, nil).Indices(ctx, l); err == nil {
+		t.Error("Indices() with no receipt source: no error")
+	}
+
+	l.Receipts = bb.receipts[:2]
+	if _, err := NewBalances(testNetwork, nil).Indices(ctx, l); err == nil {
+		t.Error("Indices() with too few receipts: no error")
+	}
+
+	l.Receipts = bb.receipts
+	r := Index(bb.recipient.Bytes())
+	_, err := NewBalances(testNetwork, nil).Map(ctx, l, map[string][]byte{r: []byte("junk")})
+	if cerr, ok := err.(*CorruptLeafError); !ok {
+		t.Errorf("Map() with a corrupt leaf = %v, want *CorruptLeafError", err)
+	} else if string(cerr.Index) != r {
+		t.Errorf("Map() found leaf %x corrupt, want %x", cerr.Index, r)
+	}
+}
+
+func TestMapLeavesCorrupt(t *testing.T) {
+	ctx := context.Background()
+	bb := newBalanceBlock(t)
+	l := &blockleaf.Leaf{Version: blockleaf.VersionBlock, Block: bb.block, Receipts: bb.receipts}
+	s, r := Index(bb.sender.Bytes()), Index(bb.recipient.Bytes())
+	qi, _, err := quarantine(fmt.Sprintf("%x:%d", r, 1), &Quarantined{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		act         Action
+		wantErr     bool
+		quarantined bool
+	}{
+		{act: Halt, wantErr: true},
+		{act: Skip},
+		{act: Quarantine, quarantined: true},
+	} {
+		t.Run(fmt.Sprintf("action %d", tc.act), func(t *testing.T) {
+			m := &Mapper{opts: Opts{OnError: func(error) Action { return tc.act }}}
+			tgt := &target{Target: Target{MapID: 1, Func: NewBalances(testNetwork, nil)}}
+			leaves := map[string][]byte{s: []byte("1000000"), r: []byte("junk")}
+
+			updates, err := m.mapLeaves(ctx, tgt, l, leaves)
+			if tc.wantErr {
+				if _, ok := err.(*CorruptLeafError); !ok {
+					t.Errorf("mapLeaves() = %v, want *CorruptLeafError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mapLeaves(): %v", err)
+			}
+			if v, ok := updates[r]; ok {
+				t.Errorf("mapLeaves() set corrupt leaf to %q", v)
+			}
+			if got, want := string(updates[s]), sum(1000000, bb.senderDelta); got != want {
+				t.Errorf("mapLeaves() set sender to %q, want %q", got, want)
+			}
+
+			v, ok := updates[qi]
+			if ok != tc.quarantined {
+				t.Fatalf("mapLeaves() quarantined leaf: %v, want %v", ok, tc.quarantined)
+			}
+			if !ok {
+				return
+			}
+			var q Quarantined
+			if err := json.Unmarshal(v, &q); err != nil {
+				t.Fatalf("Failed to parse quarantine leaf: %v", err)
+			}
+			if q.Block != 1 || string(q.Index) != r || string(q.Value) != "junk" || string(q.Update) != "100" {
+				t.Errorf("mapLeaves() quarantined %+v", q)
+			}
+		})
+	}
+}
+
+// mapBlock maps b with the given receipts onto an empty map, so each balance leaf in
+// the result holds the account's delta.
+func mapBlock(t *testing.T, b *types.Block, receipts []*types.Receipt) map[string][]byte {
+	t.Helper()
+	l := &blockleaf.Leaf{Version: blockleaf.VersionBlock, Block: b, Receipts: receipts}
+	updates, err := NewBalances(testNetwork, nil).Map(context.Background(), l, nil)
+	if err != nil {
+		t.Fatalf("Map(): %v", err)
+	}
+	return updates
+}
+
+func TestBalancesFees(t *testing.T) {
+	key := testKey(t)
+	miner := common.BigToAddress(big.NewInt(1))
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	recipient := common.BigToAddress(big.NewInt(2))
+
+	for _, tc := range []struct {
+		desc    string
+		receipt *types.Receipt
+		// moved is whether the value of the transaction was paid.
+		moved bool
+	}{
+		{
+			desc:    "success",
+			receipt: &types.Receipt{Status: types.ReceiptStatusSuccessful, GasUsed: 21000},
+			moved:   true,
+		},
+		{
+			desc:    "failed",
+			receipt: &types.Receipt{Status: types.ReceiptStatusFailed, GasUsed: 30000},
+		},
+		{
+			// Receipts from before Byzantium have a state root, and no status.
+			desc:    "pre-byzantium",
+			receipt: &types.Receipt{PostState: []byte{1}, Status: types.ReceiptStatusFailed, GasUsed: 21000},
+			moved:   true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			// The transaction allows more gas than it uses, and only what it uses is paid.
+			tx := types.NewTransaction(0, recipient, big.NewInt(100), 50000, big.NewInt(3), nil)
+			updates := mapBlock(t, testBlock(t, 1, miner, key, tx), []*types.Receipt{tc.receipt})
+
+			fee := big.NewInt(3 * int64(tc.receipt.GasUsed))
+			value := big.NewInt(0)
+			if tc.moved {
+				value = big.NewInt(100)
+			}
+			want := map[common.Address]string{
+				sender: new(big.Int).Neg(new(big.Int).Add(fee, value)).String(),
+				miner:  new(big.Int).Add(frontierReward, fee).String(),
+			}
+			if tc.moved {
+				want[recipient] = value.String()
+			}
+			for a, v := range want {
+				if got := string(updates[Index(a.Bytes())]); got != v {
+					t.Errorf("Map() set %x to %q, want %q", a, got, v)
+				}
+			}
+			if got, want := len(updates), len(want); got != want {
+				t.Errorf("Map() returned %d leaves, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestBalancesContracts(t *testing.T) {
+	key := testKey(t)
+	miner := common.BigToAddress(big.NewInt(1))
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	derived := crypto.CreateAddress(sender, 4)
+	given := common.BigToAddress(big.NewInt(9))
+
+	for _, tc := range []struct {
+		desc    string
+		receipt *types.Receipt
+		// want is the address of the contract created, if any.
+		want *common.Address
+	}{
+		{
+			desc:    "address in receipt",
+			receipt: &types.Receipt{Status: types.ReceiptStatusSuccessful, GasUsed: 50000, ContractAddress: given},
+			want:    &given,
+		},
+		{
+			desc:    "address from nonce",
+			receipt: &types.Receipt{Status: types.ReceiptStatusSuccessful, GasUsed: 50000},
+			want:    &derived,
+		},
+		{
+			desc:    "failed",
+			receipt: &types.Receipt{Status: types.ReceiptStatusFailed, GasUsed: 50000},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			tx := types.NewContractCreation(4, big.NewInt(10), 100000, big.NewInt(1), []byte{0})
+			b := testBlock(t, 3, miner, key, tx)
+			updates := mapBlock(t, b, []*types.Receipt{tc.receipt})
+
+			for _, a := range []common.Address{given, derived} {
+				created := tc.want != nil && a == *tc.want
+				bal, ok := updates[Index(a.Bytes())]
+				if ok != created || (created && string(bal) != "10") {
+					t.Errorf("Map() set balance of %x to %q, want contract created: %v", a, bal, created)
+				}
+				v, ok := updates[contractIndex(a)]
+				if ok != created {
+					t.Errorf("Map() recorded contract %x: %v, want %v", a, ok, created)
+				}
+				if !ok {
+					continue
+				}
+				var c Contract
+				if err := json.Unmarshal(v, &c); err != nil {
+					t.Fatalf("Failed to parse contract leaf: %v", err)
+				}
+				if want := (Contract{Creator: sender, Block: 3, TxHash: b.Transactions()[0].Hash()}); c != want {
+					t.Errorf("Map() recorded contract %+v, want %+v", c, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// CorruptLeafError is returned by a MapFunction when a leaf in the map doesn't hold
+// what it should, such as a balance leaf which doesn't hold a balance.
+type CorruptLeafError struct {
+	Index []byte
+	Value []byte
+}
+
+func (e *CorruptLeafError) Error() string {
+	return fmt.Sprintf("leaf value for %x... (%s) is corrupt", e.Index[:5], e.Value)
+}
+
+// InconsistencyError is returned by Map when the map or log doesn't hold what the
+// Mapper expects, for example when the map returns the wrong leaves.
+type InconsistencyError struct {
+	Block int64
+	Err   error
+}
+
+func (e *InconsistencyError) Error() string {
+	return fmt.Sprintf("inconsistency at block %d: %v", e.Block, e.Err)
+}
+
+// DecodeError is found when a leaf in the log doesn't hold a block that can be mapped.
+type DecodeError struct {
+	LogIndex int64
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("can't decode block at log index %d: %v", e.LogIndex, e.Err)
+}
+
+// FetchError is returned by a MapFunction, or by the Mapper itself, when data needed to
+// map a block couldn't be fetched, for example receipts from geth. It's taken to be
+// transient, so the Mapper tries again.
+type FetchError struct {
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return e.Err.Error()
+}
+
+// Action is what to do about a *CorruptLeafError or *DecodeError.
+type Action int
+
+const (
+	// Halt stops the Mapper, and Map returns the error.
+	Halt Action = iota
+	// Skip carries on without the bad item: a corrupt leaf is left as it is, and a block
+	// which can't be decoded isn't mapped.
+	Skip
+	// Quarantine is like Skip, but also records the item in a leaf in the map so that
+	// it can be dealt with later.
+	Quarantine
+)
+
+// Quarantined is the value of a leaf recording an item set aside by Quarantine. For a
+// corrupt leaf, Update is the value the block would have given it had it been empty,
+// which for a balance is the change that wasn't applied.
+type Quarantined struct {
+	Block    int64
+	Err      string
+	LogIndex int64  `json:",omitempty"`
+	Index    []byte `json:",omitempty"`
+	Value    []byte `json:",omitempty"`
+	Update   []byte `json:",omitempty"`
+}
+
+// quarantine returns the index and value of the leaf holding q, whose index is derived
+// from key.
+func quarantine(key string, q *Quarantined) (string, []byte, error) {
+	v, err := json.Marshal(q)
+	if err != nil {
+		return "", nil, err
+	}
+	return Index([]byte("quarantine:" + key)), v, nil
+}
+
+// action returns what Opts.OnError says to do about err, or Halt if it isn't set.
+func (m *Mapper) action(err error) Action {
+	if m.opts.OnError == nil {
+		return Halt
+	}
+	return m.opts.OnError(err)
+}
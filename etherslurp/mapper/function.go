@@ -0,0 +1,60 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+	"github.com/google/trillian-examples/etherslurp/chain"
+)
+
+// MapFunction builds a map from the blocks in the log. The Mapper passes it every block
+// in order, along with the current values of the leaves it asks for, and writes the
+// leaves it returns to the map. Leaf indices are the raw bytes of the index as a string.
+type MapFunction interface {
+	// Indices returns the indices of the leaves whose values Map needs for the block in
+	// l. It must not change l, which is shared with the other MapFunctions.
+	Indices(ctx context.Context, l *blockleaf.Leaf) ([]string, error)
+	// Map returns the new values of the leaves changed by the block in l, keyed by
+	// index. leaves holds the current value of each leaf returned by Indices, which is
+	// empty if the leaf has never been set. If one of them doesn't hold what it should,
+	// Map returns a *CorruptLeafError, and may be called again with that leaf empty so
+	// that the rest of the block can be applied.
+	Map(ctx context.Context, l *blockleaf.Leaf, leaves map[string][]byte) (map[string][]byte, error)
+}
+
+// Target is a map, and the MapFunction which builds it.
+type Target struct {
+	MapID int64
+	Func  MapFunction
+}
+
+// senders returns the sender of each transaction in b.
+func senders(network *chain.Network, b *types.Block) ([]common.Address, error) {
+	signer := types.MakeSigner(network.Config, b.Number())
+	from := make([]common.Address, 0, len(b.Transactions()))
+	for i, tx := range b.Transactions() {
+		a, err := types.Sender(signer, tx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to derive sender on tx@%d@%v", i, b.Number())
+		}
+		from = append(from, a)
+	}
+	return from, nil
+}
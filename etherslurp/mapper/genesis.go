@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/golang/glog"
+	"github.com/google/trillian"
+)
+
+// genesisIndex is the index of the leaf recording that the genesis allocation has
+// been applied to the map.
+var genesisIndex = Index([]byte("genesis-applied"))
+
+// GenesisApplied is the value of the leaf recording that the genesis allocation has
+// been applied to the map.
+type GenesisApplied struct {
+	Hash     common.Hash
+	Accounts int
+}
+
+// ReadGenesis reads a genesis specification, as given to 'geth init', from a file.
+func ReadGenesis(path string) (*core.Genesis, error) {
+	j, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var g core.Genesis
+	if err := json.Unmarshal(j, &g); err != nil {
+		return nil, fmt.Errorf("failed to parse genesis %s: %v", path, err)
+	}
+	return &g, nil
+}
+
+// ApplyGenesis credits the accounts pre-funded by g in mapID, which is built by Balances.
+// The balances are written in the same map revision as a leaf recording that g has been
+// applied, so it's safe to call this each time the Mapper starts.
+func (m *Mapper) ApplyGenesis(ctx context.Context, mapID int64, g *core.Genesis) error {
+	h := g.ToBlock(nil).Header()
+	if err := m.network.CheckGenesis(h); err != nil {
+		return fmt.Errorf("genesis is not for %s: %v", m.network.Name, err)
+	}
+
+	deltas := make(map[string]*big.Int)
+	for a, acc := range g.Alloc {
+		if acc.Balance != nil && acc.Balance.Sign() != 0 {
+			addDelta(deltas, a, acc.Balance)
+		}
+	}
+
+	getRequest := &trillian.GetMapLeavesRequest{
+		MapId: mapID,
+		Index: [][]byte{[]byte(genesisIndex)},
+	}
+	for k := range deltas {
+		getRequest.Index = append(getRequest.Index, []byte(k))
+	}
+	get, err := m.tmap.GetLeaves(ctx, getRequest)
+	if err != nil {
+		return fmt.Errorf("failed to get genesis balances: %v", err)
+	}
+	if got, want := len(get.MapLeafInclusion), len(getRequest.Index); got != want {
+		return fmt.Errorf("got %d leaves, expected %d", got, want)
+	}
+
+	meta, err := revisionMetadata(0)
+	if err != nil {
+		return err
+	}
+	setRequest := &trillian.SetMapLeavesRequest{MapId: mapID, Metadata: meta}
+	for _, l := range get.MapLeafInclusion {
+		k := string(l.Leaf.Index)
+		if k == genesisIndex {
+			if len(l.Leaf.LeafValue) > 0 {
+				glog.Infof("Genesis already applied: %s", l.Leaf.LeafValue)
+				return nil
+			}
+			continue
+		}
+		bal := big.NewInt(0)
+		if len(l.Leaf.LeafValue) > 0 {
+			var ok bool
+			if bal, ok = bal.SetString(string(l.Leaf.LeafValue), 10); !ok {
+				return &CorruptLeafError{Index: l.Leaf.Index, Value: l.Leaf.LeafValue}
+			}
+		}
+		bal.Add(bal, deltas[k])
+		l.Leaf.LeafValue = []byte(bal.String())
+		setRequest.Leaves = append(setRequest.Leaves, l.Leaf)
+	}
+
+	v, err := json.Marshal(GenesisApplied{Hash: h.Hash(), Accounts: len(deltas)})
+	if err != nil {
+		return err
+	}
+	setRequest.Leaves = append(setRequest.Leaves, &trillian.MapLeaf{Index: []byte(genesisIndex), LeafValue: v})
+
+	glog.Infof("Applying genesis allocation to %d accounts", len(deltas))
+	if _, err := m.tmap.SetLeaves(ctx, setRequest); err != nil {
+		return fmt.Errorf("failed to set genesis balances: %v", err)
+	}
+	return nil
+}
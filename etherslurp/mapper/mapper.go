@@ -17,14 +17,17 @@ package mapper
 import (
 	"context"
 	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
+	"sort"
 	"time"
 
-	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/golang/glog"
 	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+	"github.com/google/trillian-examples/etherslurp/chain"
 )
 
 const (
@@ -33,33 +36,110 @@ const (
 
 var oneEtherRatio = big.NewFloat(float64(1) / float64(oneEther))
 
-// Mapper handles the mapping between the Trillian Log and Map.
+// Mapper reads the blocks in a Trillian Log, and builds one or more Trillian Maps from
+// them using MapFunctions.
 type Mapper struct {
-	logID, mapID int64
-	tlog         trillian.TrillianLogClient
-	tmap         trillian.TrillianMapClient
+	logID   int64
+	tlog    trillian.TrillianLogClient
+	tmap    trillian.TrillianMapClient
+	network *chain.Network
+	opts    Opts
+	targets []*target
+
+	blocks chan *logBlock
+}
 
-	unsortedBlocks chan *types.Block
-	sortedBlocks   chan *types.Block
+// target is a map being built by the Mapper, with the changes to it that haven't been
+// written yet.
+type target struct {
+	Target
+	// next is the next block to apply to the map.
+	next int64
+	// pending holds the leaves changed since the map was last written, and last is the
+	// last block applied to them, or -1 if there are none. lastIndex is the index of the
+	// log leaf holding that block.
+	pending   map[string][]byte
+	last      int64
+	lastIndex int64
 }
 
-// New creates a new Mapper.
-func New(tl trillian.TrillianLogClient, logID int64, tm trillian.TrillianMapClient, mapID int64) *Mapper {
-	return &Mapper{
-		logID: logID,
-		mapID: mapID,
-		tlog:  tl,
-		tmap:  tm,
+// logBlock is a block read from the log, or why the leaf holding it couldn't be decoded.
+type logBlock struct {
+	index int64
+	leaf  *blockleaf.Leaf
+	err   error
+}
 
-		unsortedBlocks: make(chan *types.Block, 200),
-		sortedBlocks:   make(chan *types.Block, 200),
+// Opts encapsulates the options that can be used with a Mapper.
+type Opts struct {
+	// Window is the number of blocks whose changes are written to each map together, in
+	// a single revision.
+	Window int
+	// FlushInterval is how long to wait for more blocks before writing a partial window.
+	FlushInterval time.Duration
+	// OnError, if set, decides what to do about a *DecodeError or *CorruptLeafError. If
+	// it isn't set, the Mapper halts.
+	OnError func(error) Action
+}
+
+// New creates a new Mapper, which maps a log of blocks from the given network into each
+// of targets.
+func New(tl trillian.TrillianLogClient, logID int64, tm trillian.TrillianMapClient, network *chain.Network, opts Opts, targets ...Target) *Mapper {
+	if opts.Window <= 0 {
+		opts.Window = 1
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 10 * time.Second
 	}
+	m := &Mapper{
+		logID:   logID,
+		tlog:    tl,
+		tmap:    tm,
+		network: network,
+		opts:    opts,
+
+		blocks: make(chan *logBlock, 200),
+	}
+	for _, t := range targets {
+		m.targets = append(m.targets, &target{Target: t, pending: make(map[string][]byte), last: -1})
+	}
+	return m
 }
 
 const maxNumBlocks int64 = 100
 
+// logIndexForBlock returns the index of the log leaf holding block number num. The
+// log is pre-ordered by the follower, so leaf N holds block N.
+func logIndexForBlock(num int64) int64 {
+	return num
+}
+
 var numBlocks = maxNumBlocks
 
+// checkGenesis waits for the first block to appear in the log, and checks that it's the
+// genesis block of the Mapper's network.
+func (m *Mapper) checkGenesis(ctx context.Context) error {
+	for {
+		rsp, err := m.tlog.GetLeavesByIndex(ctx, &trillian.GetLeavesByIndexRequest{LogId: m.logID, LeafIndex: []int64{0}})
+		if err == nil && len(rsp.Leaves) == 1 {
+			l, err := blockleaf.Decode(rsp.Leaves[0].LeafValue)
+			if err != nil {
+				return fmt.Errorf("failed to decode genesis block: %v", err)
+			}
+			if err := m.network.CheckGenesis(l.BlockHeader()); err != nil {
+				return fmt.Errorf("log is not for %s: %v", m.network.Name, err)
+			}
+			return nil
+		}
+		glog.Warningf("Waiting for genesis block in log: %v", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
 func (m *Mapper) fetchBlocks(ctx context.Context, from int64) {
 nextAttempt:
 	for {
@@ -71,7 +151,7 @@ nextAttempt:
 
 		leaves := make([]int64, numBlocks)
 		for i := int64(0); i < numBlocks; i++ {
-			leaves[i] = from + i
+			leaves[i] = logIndexForBlock(from + i)
 		}
 
 		entries, err := m.tlog.GetLeavesByIndex(ctx, &trillian.GetLeavesByIndexRequest{LogId: m.logID, LeafIndex: leaves})
@@ -88,67 +168,35 @@ nextAttempt:
 			numBlocks++
 		}
 
+		sort.Slice(entries.Leaves, func(i, j int) bool { return entries.Leaves[i].LeafIndex < entries.Leaves[j].LeafIndex })
 		for _, l := range entries.Leaves {
-			block := &types.Block{}
-			if err := rlp.DecodeBytes(l.LeafValue, block); err != nil {
-				glog.Errorf("Failed to decode block from log at index %d: %v", l.LeafIndex, err)
+			if want := logIndexForBlock(from); l.LeafIndex != want {
+				glog.Errorf("Got leaf at index %d, wanted %d", l.LeafIndex, want)
 				continue nextAttempt
 			}
-			m.unsortedBlocks <- block
-		}
-
-		from += numBlocks
-	}
-}
-
-func (m *Mapper) pipelineBlocks(ctx context.Context, from int64) {
-	blocksByNumber := make(map[int64]*types.Block)
-
-nextAttempt:
-	for {
-		select {
-		case <-ctx.Done():
-			for range m.unsortedBlocks {
+			lb := &logBlock{index: l.LeafIndex}
+			leaf, err := blockleaf.Decode(l.LeafValue)
+			switch {
+			case err != nil:
+				lb.err = &DecodeError{LogIndex: l.LeafIndex, Err: err}
+			case leaf.Block == nil:
+				lb.err = &DecodeError{LogIndex: l.LeafIndex, Err: errors.New("log holds only a header, can't map transactions")}
+			case leaf.Block.Number().Int64() != from:
+				lb.err = &DecodeError{LogIndex: l.LeafIndex, Err: fmt.Errorf("leaf holds block %v", leaf.Block.Number())}
+			default:
+				leaf.LogIndex = l.LeafIndex
+				lb.leaf = leaf
 			}
-			return
-		case b := <-m.unsortedBlocks:
-			blocksByNumber[b.Number().Int64()] = b
-			// try to sort some blocks:
-			for {
-				b, found := blocksByNumber[from]
-				if !found {
-					continue nextAttempt
-				}
-				delete(blocksByNumber, from)
-				m.sortedBlocks <- b
-				from++
+			select {
+			case <-ctx.Done():
+				return
+			case m.blocks <- lb:
 			}
+			from++
 		}
 	}
 }
 
-func isProtectedV(V *big.Int) bool {
-	if V.BitLen() <= 8 {
-		v := V.Uint64()
-		return v != 27 && v != 28
-	}
-	// anything not 27 or 28 are considered unprotected
-	return true
-}
-
-// deriveChainID derives the chain id from the given v parameter
-func deriveChainID(v *big.Int) *big.Int {
-	if v.BitLen() <= 64 {
-		v := v.Uint64()
-		if v == 27 || v == 28 {
-			return new(big.Int)
-		}
-		return new(big.Int).SetUint64((v - 35) / 2)
-	}
-	v = new(big.Int).Sub(v, big.NewInt(35))
-	return v.Div(v, big.NewInt(2))
-}
-
 func ethBalance(b *big.Int) string {
 	a := &big.Float{}
 	a.SetInt(b)
@@ -156,169 +204,345 @@ func ethBalance(b *big.Int) string {
 	return fmt.Sprintf("Ξ%s", a.String())
 }
 
-// deriveSigner makes a *best* guess about which signer to use.
-func deriveSigner(V *big.Int) types.Signer {
-	if V.Sign() != 0 && isProtectedV(V) {
-		return types.NewEIP155Signer(deriveChainID(V))
-	}
-
-	return types.HomesteadSigner{}
-}
-
 func fmtAddress(a []byte) string {
 	return fmt.Sprintf("%x", a[:])
 }
 
-func index(a []byte) string {
+// Index returns the index of the map leaf for key a, which is its sha256 hash. Account
+// balances, for example, are at the index of the account's address.
+func Index(a []byte) string {
 	r := sha256.Sum256(a)
 	return string(r[:])
 }
 
-func (m *Mapper) mapTransactionsFrom(ctx context.Context, b *types.Block) error {
-	numTX := len(b.Transactions())
-	if numTX == 0 {
-		return nil
-	}
-	glog.Infof("Mapping %d transactions from block @ %v", len(b.Transactions()), b.Number())
+// RevisionMetadata is stored as the metadata of each map revision written by the Mapper,
+// tying the revision to the chain.
+type RevisionMetadata struct {
+	// Block is the number of the last block whose effects are included in the revision.
+	Block int64
+}
 
-	deltas := make(map[string]*big.Int)
+func revisionMetadata(block int64) ([]byte, error) {
+	return json.Marshal(RevisionMetadata{Block: block})
+}
+
+// checkpointIndex is the index of the leaf recording how far the Mapper has got.
+var checkpointIndex = Index([]byte("checkpoint"))
 
-	// Add miner credit
-	minerIndex := index(b.Coinbase().Bytes())
-	credit := big.NewInt(int64(5) * int64(1+len(b.Uncles())/32))
-	glog.Infof("Miner credit: %s", credit.String())
-	credit.Mul(credit, big.NewInt(oneEther))
-	deltas[minerIndex] = credit
+// Checkpoint is the value of the leaf recording the last block applied to the map. It
+// is written in the same revision as that block's changes.
+type Checkpoint struct {
+	Block    int64
+	LogIndex int64
+}
 
-	for i, tx := range b.Transactions() {
-		v, _, _ := tx.RawSignatureValues()
-		if v == nil {
-			return fmt.Errorf("nil signature on tx@%d@%v", i, b.Number())
+// checkpoint returns the Mapper's checkpoint from map mapID, or nil if no blocks have
+// been applied to it yet.
+func (m *Mapper) checkpoint(ctx context.Context, mapID int64) (*Checkpoint, error) {
+	get, err := m.tmap.GetLeaves(ctx, &trillian.GetMapLeavesRequest{MapId: mapID, Index: [][]byte{[]byte(checkpointIndex)}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get checkpoint: %v", err)
+	}
+	if len(get.MapLeafInclusion) != 1 {
+		return nil, fmt.Errorf("got %d checkpoint leaves, expected 1", len(get.MapLeafInclusion))
+	}
+	v := get.MapLeafInclusion[0].Leaf.LeafValue
+	if len(v) == 0 {
+		return nil, nil
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(v, &cp); err != nil {
+		return nil, fmt.Errorf("checkpoint %q is corrupt: %v", v, err)
+	}
+	return &cp, nil
+}
+
+// apply passes the block in l to t's MapFunction, and adds the leaves it changes to t's
+// pending leaves. Leaves the MapFunction needs are read from the pending leaves if
+// they're there, and otherwise from the map.
+func (m *Mapper) apply(ctx context.Context, t *target, l *blockleaf.Leaf) error {
+	num := l.Block.Number().Int64()
+	indices, err := t.Func.Indices(ctx, l)
+	if err != nil {
+		return err
+	}
+	leaves := make(map[string][]byte)
+	getRequest := &trillian.GetMapLeavesRequest{MapId: t.MapID}
+	for _, i := range indices {
+		if _, ok := leaves[i]; ok {
+			continue
 		}
-		signer := deriveSigner(v)
-		from, err := types.Sender(signer, tx)
-		if err != nil {
-			return fmt.Errorf("unable to derive sender on tx@%d@%v", i, b.Number())
+		if v, ok := t.pending[i]; ok {
+			leaves[i] = v
+			continue
 		}
+		leaves[i] = nil
+		getRequest.Index = append(getRequest.Index, []byte(i))
+	}
 
-		// Handle sender costs
-		sIndex := index(from.Bytes())
-		sBal, ok := deltas[sIndex]
-		if !ok {
-			sBal = big.NewInt(0)
+	if len(getRequest.Index) > 0 {
+		glog.V(1).Infof("Get %d map leaves from map %d...", len(getRequest.Index), t.MapID)
+		get, err := m.tmap.GetLeaves(ctx, getRequest)
+		if err != nil {
+			return &FetchError{Err: fmt.Errorf("failed to get leaves from map %d: %v", t.MapID, err)}
 		}
-		sBal.Sub(sBal, tx.Cost())
-		deltas[sIndex] = sBal
-
-		to := tx.To()
-		if to == nil {
-			glog.Infof("start-contract TX with nil To: address %d@%v", i, b.Number())
-			continue
+		if ld, ll := len(getRequest.Index), len(get.MapLeafInclusion); ld != ll {
+			return &InconsistencyError{Block: num, Err: fmt.Errorf("got %d leaves from map %d, expected %d", ll, t.MapID, ld)}
 		}
+		for _, inc := range get.MapLeafInclusion {
+			k := string(inc.Leaf.Index)
+			if v, ok := leaves[k]; !ok || v != nil {
+				return &InconsistencyError{Block: num, Err: fmt.Errorf("got leaf %x from map %d, which wasn't asked for", inc.Leaf.Index, t.MapID)}
+			}
+			leaves[k] = inc.Leaf.LeafValue
+		}
+	}
+
+	updates, err := m.mapLeaves(ctx, t, l, leaves)
+	if err != nil {
+		return err
+	}
+	for k, v := range updates {
+		t.pending[k] = v
+	}
+	t.last = num
+	t.lastIndex = l.LogIndex
+	return nil
+}
 
-		rIndex := index(to.Bytes())
-		rBal, ok := deltas[rIndex]
+// mapLeaves calls t's MapFunction for the block in l. A corrupt leaf which Opts.OnError
+// says to skip or quarantine is emptied and the block mapped again, after which the
+// leaf is left as it was and, if quarantined, what the block would have set it to is
+// recorded.
+func (m *Mapper) mapLeaves(ctx context.Context, t *target, l *blockleaf.Leaf, leaves map[string][]byte) (map[string][]byte, error) {
+	num := l.Block.Number().Int64()
+	corrupt := make(map[string]*CorruptLeafError)
+	quarantined := make(map[string]bool)
+	for {
+		updates, err := t.Func.Map(ctx, l, leaves)
+		cerr, ok := err.(*CorruptLeafError)
 		if !ok {
-			rBal = big.NewInt(0)
+			if err != nil {
+				return nil, err
+			}
+			for k, cerr := range corrupt {
+				if quarantined[k] {
+					qi, qv, err := quarantine(fmt.Sprintf("%x:%d", k, num), &Quarantined{Block: num, Err: cerr.Error(), Index: cerr.Index, Value: cerr.Value, Update: updates[k]})
+					if err != nil {
+						return nil, err
+					}
+					updates[qi] = qv
+				}
+				delete(updates, k)
+			}
+			return updates, nil
 		}
-		rBal.Add(rBal, tx.Value())
-		deltas[rIndex] = rBal
-
-		{
-			// only using floats for printing, map should use the fixed point representation!
-			sender := fmtAddress(from.Bytes())
-			recipient := fmtAddress(to.Bytes())
-			amount := float64(tx.Value().Int64()) / float64(oneEther)
-			cost := float64(tx.Cost().Int64()) / float64(oneEther)
-			glog.Infof("Ξ%f from %s... (%x...) -> %s... (%x...), costing Ξ%f", amount, sender[:5], sIndex[:5], recipient[:5], rIndex[:5], cost)
+
+		k := string(cerr.Index)
+		if _, ok := corrupt[k]; ok || len(leaves[k]) == 0 {
+			return nil, fmt.Errorf("%v, though it was emptied", cerr)
+		}
+		switch act := m.action(cerr); act {
+		case Skip:
+			glog.Warningf("Map %d: %v, leaving it unchanged", t.MapID, cerr)
+		case Quarantine:
+			glog.Warningf("Map %d: %v, quarantining it", t.MapID, cerr)
+			quarantined[k] = true
+		default:
+			return nil, cerr
 		}
+		corrupt[k] = cerr
+		leaves[k] = nil
 	}
-	glog.V(1).Infof("Have %d deltas", len(deltas))
-	if len(deltas) == 0 {
+}
+
+// flush writes t's pending leaves to its map as a single revision, along with a
+// checkpoint for the last block applied to them.
+func (m *Mapper) flush(ctx context.Context, t *target) error {
+	if t.last < 0 {
 		return nil
 	}
-
-	getRequest := &trillian.GetMapLeavesRequest{
-		MapId: m.mapID,
+	meta, err := revisionMetadata(t.last)
+	if err != nil {
+		return err
+	}
+	setRequest := &trillian.SetMapLeavesRequest{
+		MapId:    t.MapID,
+		Leaves:   make([]*trillian.MapLeaf, 0, len(t.pending)+1),
+		Metadata: meta,
 	}
-	for k := range deltas {
-		getRequest.Index = append(getRequest.Index, []byte(k))
+	for k, v := range t.pending {
+		setRequest.Leaves = append(setRequest.Leaves, &trillian.MapLeaf{Index: []byte(k), LeafValue: v})
 	}
 
-	glog.V(1).Info("Get map leaves...")
-	get, err := m.tmap.GetLeaves(ctx, getRequest)
+	cp, err := json.Marshal(Checkpoint{Block: t.last, LogIndex: t.lastIndex})
 	if err != nil {
-		return fmt.Errorf("failed to get current balances: %v", err)
-	}
-	glog.V(1).Infof("Got %d map leaves.", len(get.MapLeafInclusion))
-
-	if ld, ll := len(deltas), len(get.MapLeafInclusion); ld != ll {
-		glog.Exitf("Got %d leaves, expected %d", ll, ld)
+		return err
 	}
+	setRequest.Leaves = append(setRequest.Leaves, &trillian.MapLeaf{Index: []byte(checkpointIndex), LeafValue: cp})
 
-	setRequest := &trillian.SetMapLeavesRequest{
-		MapId:  m.mapID,
-		Leaves: make([]*trillian.MapLeaf, 0),
+	glog.V(1).Infof("Setting %d leaves in map %d, up to block %d.", len(setRequest.Leaves), t.MapID, t.last)
+	if _, err := m.tmap.SetLeaves(ctx, setRequest); err != nil {
+		return &FetchError{Err: fmt.Errorf("failed to write blocks up to %d to map %d: %v", t.last, t.MapID, err)}
 	}
+	t.pending = make(map[string][]byte)
+	t.last = -1
+	return nil
+}
 
-	for _, l := range get.MapLeafInclusion {
-		bal := big.NewInt(0)
-		if len(l.Leaf.LeafValue) > 0 {
-			var ok bool
-			bal, ok = bal.SetString(string(l.Leaf.LeafValue), 10)
-			if !ok {
-				glog.Warningf("Leaf value for %x... (%s) is corrupt, resetting to zero balance", l.Leaf.Index[:5], string(l.Leaf.LeafValue))
-				bal = big.NewInt(0)
-			}
+// retry calls f until it returns something other than a *FetchError, waiting longer
+// each time up to a minute, or until ctx is done.
+func retry(ctx context.Context, f func() error) error {
+	wait := time.Second
+	for {
+		err := f()
+		if _, ok := err.(*FetchError); !ok {
+			return err
 		}
-		k := string(l.Leaf.Index)
-		d, ok := deltas[k]
-		if !ok {
-			glog.Warning("No delta for leaf index %x", l.Leaf.Index)
-			continue
+		glog.Warningf("%v, trying again in %v", err, wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > time.Minute {
+			wait = time.Minute
 		}
-		delete(deltas, k)
-		glog.V(1).Infof("index %x... had: %s", l.Leaf.Index[:5], ethBalance(bal))
-		bal.Add(bal, d)
-		l.Leaf.LeafValue = []byte(bal.String())
-		setRequest.Leaves = append(setRequest.Leaves, l.Leaf)
-		glog.Infof("index %x... now has: %s", l.Leaf.Index[:5], ethBalance(bal))
 	}
+}
 
-	if len(deltas) != 0 {
-		glog.Exitf("Arg, didn't use all deltas, still have:\n%+v", deltas)
+// skip handles block num, which couldn't be decoded from the log leaf in lb, according
+// to act.
+func (m *Mapper) skip(t *target, num int64, lb *logBlock, act Action) error {
+	if act == Quarantine {
+		qi, qv, err := quarantine(fmt.Sprintf("block:%d", num), &Quarantined{Block: num, Err: lb.err.Error(), LogIndex: lb.index})
+		if err != nil {
+			return err
+		}
+		t.pending[qi] = qv
 	}
+	t.last = num
+	t.lastIndex = lb.index
+	return nil
+}
 
-	glog.V(1).Infof("Setting %d map leaves.", len(setRequest.Leaves))
-	_, err = m.tmap.SetLeaves(ctx, setRequest)
-	if err != nil {
-		return fmt.Errorf("failed to update balances: %v", err)
+// start works out which block to start each map at, from from or, if from is negative,
+// from the map's checkpoint. It returns the first block needed by any map.
+func (m *Mapper) start(ctx context.Context, from int64) (int64, error) {
+	first := int64(-1)
+	for _, t := range m.targets {
+		cp, err := m.checkpoint(ctx, t.MapID)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case from < 0 && cp == nil:
+			t.next = 0
+		case from < 0:
+			t.next = cp.Block + 1
+		default:
+			if cp != nil && from <= cp.Block {
+				glog.Warningf("Starting map %d at block %d, but it already includes blocks up to %d; they will be applied again", t.MapID, from, cp.Block)
+			}
+			t.next = from
+		}
+		glog.Infof("Mapping into map %d from block %d", t.MapID, t.next)
+		if first < 0 || t.next < first {
+			first = t.next
+		}
 	}
-
-	return nil
+	return first, nil
 }
 
-// Map starts mapping operations. This will continue mapping blocks until the provided context
-// expires or there is an error that cannot be handled, which will cause an exit.
-func (m *Mapper) Map(ctx context.Context, from int64) {
-	go m.fetchBlocks(ctx, 0)
-	go m.pipelineBlocks(ctx, 0)
+// Map maps blocks into each of the Mapper's maps, starting at block from or, if from is
+// negative, at the block after each map's checkpoint. It continues until the provided
+// context expires, or there is an error that Opts.OnError doesn't say to skip, which is
+// returned. A *FetchError is retried rather than returned.
+func (m *Mapper) Map(ctx context.Context, from int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
+	if len(m.targets) == 0 {
+		return errors.New("no maps to build")
+	}
+	if err := m.checkGenesis(ctx); err != nil {
+		return fmt.Errorf("refusing to map: %v", err)
+	}
+	from, err := m.start(ctx, from)
+	if err != nil {
+		return err
+	}
+	go m.fetchBlocks(ctx, from)
+
+	// Blocks are written to the maps once there are opts.Window of them, or when no more
+	// have arrived for opts.FlushInterval, so that the maps keep up with the head of
+	// the log.
+	blocks := 0
+	flush := func() error {
+		for _, t := range m.targets {
+			if err := retry(ctx, func() error { return m.flush(ctx, t) }); err != nil {
+				return err
+			}
+		}
+		blocks = 0
+		return nil
+	}
+	idle := time.NewTimer(m.opts.FlushInterval)
+	defer idle.Stop()
 	for {
 		select {
 		case <-ctx.Done():
-			return
-		case nextBlock := <-m.sortedBlocks:
-			if nextBlock.Number().Int64() < from {
-				continue
+			return ctx.Err()
+		case <-idle.C:
+			if err := flush(); err != nil {
+				return err
+			}
+			idle.Reset(m.opts.FlushInterval)
+		case next := <-m.blocks:
+			if want := logIndexForBlock(from); next.index != want {
+				return &InconsistencyError{Block: from, Err: fmt.Errorf("got log index %d, want %d", next.index, want)}
 			}
-			if nextBlock.Number().Int64() != from {
-				glog.Exitf("Got unexpected block number %s, wanted %d", nextBlock.Number(), from)
+			act := Halt
+			if next.err != nil {
+				switch act = m.action(next.err); act {
+				case Skip:
+					glog.Warningf("%v, skipping it", next.err)
+				case Quarantine:
+					glog.Warningf("%v, quarantining it", next.err)
+				default:
+					return next.err
+				}
+			}
+			for _, t := range m.targets {
+				if from < t.next {
+					continue
+				}
+				if next.err != nil {
+					err = m.skip(t, from, next, act)
+				} else {
+					err = retry(ctx, func() error { return m.apply(ctx, t, next.leaf) })
+				}
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				switch err.(type) {
+				case nil:
+				case *CorruptLeafError, *InconsistencyError:
+					return err
+				default:
+					return fmt.Errorf("couldn't map block %d into map %d: %v", from, t.MapID, err)
+				}
+				t.next = from + 1
+			}
+			if blocks++; blocks >= m.opts.Window {
+				if err := flush(); err != nil {
+					return err
+				}
 			}
-			// TODO(al): batching...
-			if err := m.mapTransactionsFrom(ctx, nextBlock); err != nil {
-				glog.Exitf("Couldn't map transactions from block %v", err)
+			if !idle.Stop() {
+				<-idle.C
 			}
+			idle.Reset(m.opts.FlushInterval)
 			from++
 		}
 	}
@@ -0,0 +1,245 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+	"github.com/google/trillian-examples/etherslurp/chain"
+	"github.com/google/trillian-examples/etherslurp/testonly"
+	"google.golang.org/grpc"
+)
+
+// fakeLog is a pre-ordered log of blocks, which can be added to as the test goes on.
+type fakeLog struct {
+	trillian.TrillianLogClient
+	mu     sync.Mutex
+	leaves [][]byte
+}
+
+func (l *fakeLog) add(t *testing.T, blocks ...*types.Block) {
+	t.Helper()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, b := range blocks {
+		raw, err := blockleaf.Encode(&blockleaf.Leaf{Version: blockleaf.VersionBlock, Block: b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.leaves = append(l.leaves, raw)
+	}
+}
+
+func (l *fakeLog) GetLeavesByIndex(ctx context.Context, req *trillian.GetLeavesByIndexRequest, opts ...grpc.CallOption) (*trillian.GetLeavesByIndexResponse, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rsp := &trillian.GetLeavesByIndexResponse{}
+	for _, i := range req.LeafIndex {
+		if i < int64(len(l.leaves)) {
+			rsp.Leaves = append(rsp.Leaves, &trillian.LogLeaf{LeafIndex: i, LeafValue: l.leaves[i]})
+		}
+	}
+	if len(rsp.Leaves) == 0 {
+		// Don't let the Mapper spin while it waits for the log to grow.
+		time.Sleep(10 * time.Millisecond)
+	}
+	return rsp, nil
+}
+
+// fakeMap is a map which keeps only its latest revision, and records each write to it.
+type fakeMap struct {
+	trillian.TrillianMapClient
+	mu     sync.Mutex
+	leaves map[string][]byte
+	writes []*trillian.SetMapLeavesRequest
+}
+
+func (m *fakeMap) GetLeaves(ctx context.Context, req *trillian.GetMapLeavesRequest, opts ...grpc.CallOption) (*trillian.GetMapLeavesResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rsp := &trillian.GetMapLeavesResponse{}
+	for _, i := range req.Index {
+		rsp.MapLeafInclusion = append(rsp.MapLeafInclusion, &trillian.MapLeafInclusion{Leaf: &trillian.MapLeaf{Index: i, LeafValue: m.leaves[string(i)]}})
+	}
+	return rsp, nil
+}
+
+func (m *fakeMap) SetLeaves(ctx context.Context, req *trillian.SetMapLeavesRequest, opts ...grpc.CallOption) (*trillian.SetMapLeavesResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range req.Leaves {
+		m.leaves[string(l.Index)] = l.LeafValue
+	}
+	m.writes = append(m.writes, req)
+	return &trillian.SetMapLeavesResponse{}, nil
+}
+
+// numWrites returns how many revisions have been written to the map.
+func (m *fakeMap) numWrites() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.writes)
+}
+
+// blockCount is a MapFunction which counts the blocks mapped, and records the log index
+// of each.
+type blockCount struct{}
+
+var countIndex = Index([]byte("count"))
+
+func logIndexIndex(num int64) string {
+	return Index([]byte(fmt.Sprintf("log-index:%d", num)))
+}
+
+func (blockCount) Indices(ctx context.Context, l *blockleaf.Leaf) ([]string, error) {
+	return []string{countIndex}, nil
+}
+
+func (blockCount) Map(ctx context.Context, l *blockleaf.Leaf, leaves map[string][]byte) (map[string][]byte, error) {
+	n := 0
+	if v := leaves[countIndex]; len(v) > 0 {
+		var err error
+		if n, err = strconv.Atoi(string(v)); err != nil {
+			return nil, &CorruptLeafError{Index: []byte(countIndex), Value: v}
+		}
+	}
+	li := logIndexIndex(l.Block.Number().Int64())
+	return map[string][]byte{
+		countIndex: []byte(strconv.Itoa(n + 1)),
+		li:         []byte(strconv.FormatInt(l.LogIndex, 10)),
+	}, nil
+}
+
+// runMapper starts m mapping from block from, and returns a function which stops it.
+func runMapper(t *testing.T, m *Mapper, from int64) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Map(ctx, from) }()
+	return func() {
+		t.Helper()
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Errorf("Map() = %v, want %v", err, context.Canceled)
+		}
+	}
+}
+
+// waitForWrites waits until tm has had n revisions written to it.
+func waitForWrites(t *testing.T, tm *fakeMap, n int) {
+	t.Helper()
+	deadline := time.After(10 * time.Second)
+	for tm.numWrites() < n {
+		select {
+		case <-deadline:
+			t.Fatalf("Timed out with %d revisions written, want %d", tm.numWrites(), n)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// checkWrite checks that write n to tm was up to block last, and mapped count blocks.
+func checkWrite(t *testing.T, tm *fakeMap, n int, last int64, count int) {
+	t.Helper()
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	req := tm.writes[n]
+	var meta RevisionMetadata
+	if err := json.Unmarshal(req.Metadata, &meta); err != nil {
+		t.Fatalf("Write %d has bad metadata %q: %v", n, req.Metadata, err)
+	}
+	if meta.Block != last {
+		t.Errorf("Write %d is up to block %d, want %d", n, meta.Block, last)
+	}
+	values := make(map[string][]byte)
+	for _, l := range req.Leaves {
+		values[string(l.Index)] = l.LeafValue
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(values[checkpointIndex], &cp); err != nil {
+		t.Fatalf("Write %d has bad checkpoint %q: %v", n, values[checkpointIndex], err)
+	}
+	if want := (Checkpoint{Block: last, LogIndex: last}); cp != want {
+		t.Errorf("Write %d has checkpoint %+v, want %+v", n, cp, want)
+	}
+	if got, want := string(values[countIndex]), strconv.Itoa(count); got != want {
+		t.Errorf("Write %d has count %s, want %s", n, got, want)
+	}
+	if got, want := string(values[logIndexIndex(last)]), strconv.FormatInt(last, 10); got != want {
+		t.Errorf("Write %d mapped block %d from log index %s, want %s", n, last, got, want)
+	}
+}
+
+// testLog returns a log holding the first n of blocks, and a network whose genesis is
+// blocks[0].
+func testLog(t *testing.T, blocks []*types.Block, n int) (*fakeLog, *chain.Network) {
+	t.Helper()
+	tl := &fakeLog{}
+	tl.add(t, blocks[:n]...)
+	return tl, &chain.Network{Name: "test", Config: testNetwork.Config, Genesis: blocks[0].Hash()}
+}
+
+func TestMapResume(t *testing.T) {
+	blocks := testonly.Chain(0, 10, nil)
+	tl, network := testLog(t, blocks, len(blocks))
+	cp, err := json.Marshal(Checkpoint{Block: 3, LogIndex: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocks 0 to 3 were mapped before the restart.
+	tm := &fakeMap{leaves: map[string][]byte{checkpointIndex: cp, countIndex: []byte("4")}}
+
+	// The remaining six blocks fill two windows, and are written without waiting.
+	m := New(tl, 1, tm, network, Opts{Window: 3, FlushInterval: time.Hour}, Target{MapID: 2, Func: blockCount{}})
+	stop := runMapper(t, m, -1)
+	waitForWrites(t, tm, 2)
+	stop()
+
+	if got := tm.numWrites(); got != 2 {
+		t.Fatalf("Map() wrote %d revisions, want 2", got)
+	}
+	checkWrite(t, tm, 0, 6, 7)
+	checkWrite(t, tm, 1, 9, 10)
+	if v, ok := tm.leaves[logIndexIndex(3)]; ok {
+		t.Errorf("Map() mapped block 3 again, from log index %s", v)
+	}
+}
+
+func TestMapFlushInterval(t *testing.T) {
+	blocks := testonly.Chain(0, 8, nil)
+	tl, network := testLog(t, blocks, 5)
+	tm := &fakeMap{leaves: make(map[string][]byte)}
+
+	// The window is never filled, so blocks are only written once the log stops
+	// growing.
+	m := New(tl, 1, tm, network, Opts{Window: 100, FlushInterval: 50 * time.Millisecond}, Target{MapID: 2, Func: blockCount{}})
+	stop := runMapper(t, m, -1)
+	defer stop()
+	waitForWrites(t, tm, 1)
+	checkWrite(t, tm, 0, 4, 5)
+
+	tl.add(t, blocks[5:]...)
+	waitForWrites(t, tm, 2)
+	checkWrite(t, tm, 1, 7, 8)
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+	"github.com/google/trillian-examples/etherslurp/chain"
+)
+
+// Nonces is a MapFunction which maps the sha256 hash of each account's address to its
+// nonce, as a decimal string. Only the nonces of accounts which have sent transactions
+// are recorded.
+type Nonces struct {
+	network *chain.Network
+}
+
+// NewNonces creates a Nonces for the given network.
+func NewNonces(network *chain.Network) *Nonces {
+	return &Nonces{network: network}
+}
+
+// Indices returns nothing, as an account's nonce after a transaction is given by the
+// transaction.
+func (n *Nonces) Indices(ctx context.Context, l *blockleaf.Leaf) ([]string, error) {
+	return nil, nil
+}
+
+// Map returns the nonce of each sender after its last transaction in the block in l.
+func (n *Nonces) Map(ctx context.Context, l *blockleaf.Leaf, leaves map[string][]byte) (map[string][]byte, error) {
+	from, err := senders(n.network, l.Block)
+	if err != nil {
+		return nil, err
+	}
+	updates := make(map[string][]byte)
+	for i, tx := range l.Block.Transactions() {
+		updates[Index(from[i].Bytes())] = []byte(strconv.FormatUint(tx.Nonce()+1, 10))
+	}
+	return updates, nil
+}
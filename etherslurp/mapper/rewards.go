@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Base block rewards for proof-of-work networks, by fork.
+var (
+	frontierReward       = new(big.Int).Mul(big.NewInt(5), big.NewInt(oneEther))
+	byzantiumReward      = new(big.Int).Mul(big.NewInt(3), big.NewInt(oneEther))
+	constantinopleReward = new(big.Int).Mul(big.NewInt(2), big.NewInt(oneEther))
+
+	big8  = big.NewInt(8)
+	big32 = big.NewInt(32)
+)
+
+// baseReward returns the base block reward for block number num.
+func baseReward(config *params.ChainConfig, num *big.Int) *big.Int {
+	switch {
+	case config.IsConstantinople(num):
+		return constantinopleReward
+	case config.IsByzantium(num):
+		return byzantiumReward
+	}
+	return frontierReward
+}
+
+// blockRewards returns the rewards due for mining b, keyed by the account they're paid
+// to. These are calculated in the same way as ethash's accumulateRewards: the miner of
+// b gets the base reward plus 1/32 of it for each uncle included, and the miner of each
+// uncle gets (8 - the uncle's depth)/8 of the base reward. Transaction fees are not
+// included. Clique networks, and the genesis block, pay no block rewards.
+func blockRewards(config *params.ChainConfig, b *types.Block) map[common.Address]*big.Int {
+	rewards := make(map[common.Address]*big.Int)
+	if config.Clique != nil || b.NumberU64() == 0 {
+		return rewards
+	}
+	credit := func(a common.Address, v *big.Int) {
+		if r, ok := rewards[a]; ok {
+			r.Add(r, v)
+		} else {
+			rewards[a] = new(big.Int).Set(v)
+		}
+	}
+
+	base := baseReward(config, b.Number())
+	reward := new(big.Int).Set(base)
+	for _, u := range b.Uncles() {
+		r := new(big.Int).Add(u.Number, big8)
+		r.Sub(r, b.Number())
+		r.Mul(r, base)
+		r.Div(r, big8)
+		credit(u.Coinbase, r)
+
+		reward.Add(reward, new(big.Int).Div(base, big32))
+	}
+	credit(b.Coinbase(), reward)
+	return rewards
+}
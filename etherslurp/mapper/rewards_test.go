@@ -0,0 +1,135 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/google/trillian-examples/etherslurp/testonly"
+)
+
+func TestBlockRewards(t *testing.T) {
+	// Byzantium is at block 10 and Constantinople at block 20.
+	pow := &params.ChainConfig{
+		ChainId:             big.NewInt(1),
+		HomesteadBlock:      big.NewInt(0),
+		ByzantiumBlock:      big.NewInt(10),
+		ConstantinopleBlock: big.NewInt(20),
+		Ethash:              new(params.EthashConfig),
+	}
+	miner := common.BigToAddress(big.NewInt(1))
+	uncle1 := common.BigToAddress(big.NewInt(2))
+	uncle2 := common.BigToAddress(big.NewInt(3))
+	// eth returns the given fraction of an ether in wei.
+	eth := func(num, denom int64) *big.Int {
+		v := new(big.Int).Mul(big.NewInt(num), big.NewInt(oneEther))
+		return v.Div(v, big.NewInt(denom))
+	}
+	uncle := func(num uint64, coinbase common.Address) *types.Header {
+		h := testonly.Header(num)
+		h.Coinbase = coinbase
+		return h
+	}
+
+	for _, tc := range []struct {
+		desc   string
+		config *params.ChainConfig
+		num    uint64
+		uncles []*types.Header
+		want   map[common.Address]*big.Int
+	}{
+		{
+			desc:   "frontier",
+			config: pow,
+			num:    5,
+			want:   map[common.Address]*big.Int{miner: eth(5, 1)},
+		},
+		{
+			desc:   "byzantium",
+			config: pow,
+			num:    10,
+			want:   map[common.Address]*big.Int{miner: eth(3, 1)},
+		},
+		{
+			desc:   "constantinople",
+			config: pow,
+			num:    20,
+			want:   map[common.Address]*big.Int{miner: eth(2, 1)},
+		},
+		{
+			desc:   "genesis",
+			config: pow,
+			num:    0,
+			want:   map[common.Address]*big.Int{},
+		},
+		{
+			desc:   "clique",
+			config: params.RinkebyChainConfig,
+			num:    5,
+			uncles: []*types.Header{uncle(4, uncle1)},
+			want:   map[common.Address]*big.Int{},
+		},
+		{
+			// Uncles one and two blocks back get 7/8 and 6/8 of the base reward, and
+			// the miner gets 1/32 for each.
+			desc:   "uncles",
+			config: pow,
+			num:    8,
+			uncles: []*types.Header{uncle(7, uncle1), uncle(6, uncle2)},
+			want: map[common.Address]*big.Int{
+				miner:  eth(5*32+2*5, 32),
+				uncle1: eth(5*7, 8),
+				uncle2: eth(5*6, 8),
+			},
+		},
+		{
+			desc:   "uncles after constantinople",
+			config: pow,
+			num:    25,
+			uncles: []*types.Header{uncle(18, uncle1)},
+			want: map[common.Address]*big.Int{
+				miner:  eth(2*32+2, 32),
+				uncle1: eth(2*1, 8),
+			},
+		},
+		{
+			desc:   "miner of own uncle",
+			config: pow,
+			num:    8,
+			uncles: []*types.Header{uncle(6, miner)},
+			want:   map[common.Address]*big.Int{miner: new(big.Int).Add(eth(5*32+5, 32), eth(5*6, 8))},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			h := testonly.Header(tc.num)
+			h.Coinbase = miner
+			b := types.NewBlock(h, nil, tc.uncles, nil)
+
+			got := blockRewards(tc.config, b)
+			if len(got) != len(tc.want) {
+				t.Errorf("blockRewards() paid %d accounts, want %d", len(got), len(tc.want))
+			}
+			for a, want := range tc.want {
+				if got[a] == nil || got[a].Cmp(want) != 0 {
+					t.Errorf("blockRewards() paid %x %v, want %v", a, got[a], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+	"github.com/google/trillian-examples/etherslurp/chain"
+)
+
+// TxEntry is the value of a leaf in the map built by TxLookup. To is nil for a
+// transaction which creates a contract.
+type TxEntry struct {
+	Block    int64
+	Index    int
+	LogIndex int64
+	From     common.Address
+	To       *common.Address `json:",omitempty"`
+	Value    *big.Int
+}
+
+// TxIndex returns the index of the leaf for the transaction with hash h in the map built
+// by TxLookup.
+func TxIndex(h common.Hash) []byte {
+	return []byte(Index(h.Bytes()))
+}
+
+// TxLookup is a MapFunction which maps the sha256 hash of each transaction's hash to
+// where it is in the chain and the log, along with who sent it, to whom and how much,
+// as a JSON TxEntry.
+type TxLookup struct {
+	network *chain.Network
+}
+
+// NewTxLookup creates a TxLookup for the given network.
+func NewTxLookup(network *chain.Network) *TxLookup {
+	return &TxLookup{network: network}
+}
+
+// Indices returns nothing, as transactions are only ever added to the map.
+func (t *TxLookup) Indices(ctx context.Context, l *blockleaf.Leaf) ([]string, error) {
+	return nil, nil
+}
+
+// Map returns an entry for each transaction in the block in l, which must have its
+// LogIndex set.
+func (t *TxLookup) Map(ctx context.Context, l *blockleaf.Leaf, leaves map[string][]byte) (map[string][]byte, error) {
+	from, err := senders(t.network, l.Block)
+	if err != nil {
+		return nil, err
+	}
+	num := l.Block.Number().Int64()
+	updates := make(map[string][]byte)
+	for i, tx := range l.Block.Transactions() {
+		v, err := json.Marshal(TxEntry{Block: num, Index: i, LogIndex: l.LogIndex, From: from[i], To: tx.To(), Value: tx.Value()})
+		if err != nil {
+			return nil, err
+		}
+		updates[string(TxIndex(tx.Hash()))] = v
+	}
+	return updates, nil
+}
+
+// TxCounts is a MapFunction which maps the sha256 hash of each account's address to the
+// number of transactions it has sent or received, as a decimal string.
+type TxCounts struct {
+	network *chain.Network
+}
+
+// NewTxCounts creates a TxCounts for the given network.
+func NewTxCounts(network *chain.Network) *TxCounts {
+	return &TxCounts{network: network}
+}
+
+// counts returns the number of transactions each account sent or received in the block
+// in l, keyed by leaf index.
+func (c *TxCounts) counts(l *blockleaf.Leaf) (map[string]uint64, error) {
+	from, err := senders(c.network, l.Block)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]uint64)
+	for i, tx := range l.Block.Transactions() {
+		accounts := []common.Address{from[i]}
+		if tx.To() != nil && *tx.To() != from[i] {
+			accounts = append(accounts, *tx.To())
+		}
+		for _, a := range accounts {
+			counts[Index(a.Bytes())]++
+		}
+	}
+	return counts, nil
+}
+
+// Indices returns the leaves of the accounts which sent or received transactions in the
+// block in l.
+func (c *TxCounts) Indices(ctx context.Context, l *blockleaf.Leaf) ([]string, error) {
+	counts, err := c.counts(l)
+	if err != nil {
+		return nil, err
+	}
+	indices := make([]string, 0, len(counts))
+	for k := range counts {
+		indices = append(indices, k)
+	}
+	return indices, nil
+}
+
+// Map adds the transactions in the block in l to the counts in leaves.
+func (c *TxCounts) Map(ctx context.Context, l *blockleaf.Leaf, leaves map[string][]byte) (map[string][]byte, error) {
+	counts, err := c.counts(l)
+	if err != nil {
+		return nil, err
+	}
+	updates := make(map[string][]byte)
+	for k, n := range counts {
+		var cur uint64
+		if v := leaves[k]; len(v) > 0 {
+			if cur, err = strconv.ParseUint(string(v), 10, 64); err != nil {
+				return nil, &CorruptLeafError{Index: []byte(k), Value: v}
+			}
+		}
+		updates[k] = []byte(strconv.FormatUint(cur+n, 10))
+	}
+	return updates, nil
+}
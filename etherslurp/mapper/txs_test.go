@@ -0,0 +1,131 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+)
+
+// txBlock is block 5, in which sender pays recipient twice, creates a contract and pays
+// itself.
+func txBlock(t *testing.T) (l *blockleaf.Leaf, sender, recipient common.Address) {
+	t.Helper()
+	key := testKey(t)
+	sender = crypto.PubkeyToAddress(key.PublicKey)
+	recipient = common.BigToAddress(big.NewInt(2))
+	gasPrice := big.NewInt(1)
+	b := testBlock(t, 5, common.BigToAddress(big.NewInt(1)), key,
+		types.NewTransaction(3, recipient, big.NewInt(1), 21000, gasPrice, nil),
+		types.NewTransaction(4, recipient, big.NewInt(2), 21000, gasPrice, nil),
+		types.NewContractCreation(5, big.NewInt(3), 100000, gasPrice, []byte{0}),
+		types.NewTransaction(6, sender, big.NewInt(4), 21000, gasPrice, nil))
+	return &blockleaf.Leaf{Version: blockleaf.VersionBlock, Block: b}, sender, recipient
+}
+
+func TestNonces(t *testing.T) {
+	ctx := context.Background()
+	l, sender, _ := txBlock(t)
+	n := NewNonces(testNetwork)
+	if indices, err := n.Indices(ctx, l); err != nil || len(indices) != 0 {
+		t.Errorf("Indices() = %x, %v, want nothing", indices, err)
+	}
+	updates, err := n.Map(ctx, l, nil)
+	if err != nil {
+		t.Fatalf("Map(): %v", err)
+	}
+	if len(updates) != 1 {
+		t.Errorf("Map() returned %d leaves, want 1", len(updates))
+	}
+	if got, want := string(updates[Index(sender.Bytes())]), "7"; got != want {
+		t.Errorf("Map() set sender's nonce to %q, want %q", got, want)
+	}
+}
+
+func TestTxLookup(t *testing.T) {
+	ctx := context.Background()
+	l, sender, recipient := txBlock(t)
+	l.LogIndex = 8
+	tl := NewTxLookup(testNetwork)
+	if indices, err := tl.Indices(ctx, l); err != nil || len(indices) != 0 {
+		t.Errorf("Indices() = %x, %v, want nothing", indices, err)
+	}
+	updates, err := tl.Map(ctx, l, nil)
+	if err != nil {
+		t.Fatalf("Map(): %v", err)
+	}
+	txs := l.Block.Transactions()
+	if len(updates) != len(txs) {
+		t.Errorf("Map() returned %d leaves, want %d", len(updates), len(txs))
+	}
+	tos := []*common.Address{&recipient, &recipient, nil, &sender}
+	for i, tx := range txs {
+		v, ok := updates[string(TxIndex(tx.Hash()))]
+		if !ok {
+			t.Errorf("Map() has no entry for tx %d", i)
+			continue
+		}
+		var e TxEntry
+		if err := json.Unmarshal(v, &e); err != nil {
+			t.Fatalf("Failed to parse entry %q: %v", v, err)
+		}
+		if e.Block != 5 || e.LogIndex != 8 || e.Index != i || e.From != sender || e.Value.Cmp(tx.Value()) != 0 {
+			t.Errorf("Map() entry for tx %d is %+v", i, e)
+		}
+		if (e.To == nil) != (tos[i] == nil) || (e.To != nil && *e.To != *tos[i]) {
+			t.Errorf("Map() entry for tx %d is to %v, want %v", i, e.To, tos[i])
+		}
+	}
+}
+
+func TestTxCounts(t *testing.T) {
+	ctx := context.Background()
+	l, sender, recipient := txBlock(t)
+	s, r := Index(sender.Bytes()), Index(recipient.Bytes())
+	c := NewTxCounts(testNetwork)
+
+	indices, err := c.Indices(ctx, l)
+	if err != nil {
+		t.Fatalf("Indices(): %v", err)
+	}
+	if len(indices) != 2 || (indices[0] != s && indices[0] != r) || (indices[1] != s && indices[1] != r) || indices[0] == indices[1] {
+		t.Errorf("Indices() = %x, want sender and recipient", indices)
+	}
+
+	// A transaction to oneself counts once.
+	updates, err := c.Map(ctx, l, map[string][]byte{s: []byte("10")})
+	if err != nil {
+		t.Fatalf("Map(): %v", err)
+	}
+	for k, want := range map[string]string{s: "14", r: "2"} {
+		if got := string(updates[k]); got != want {
+			t.Errorf("Map() set %x to %q, want %q", k, got, want)
+		}
+	}
+
+	_, err = c.Map(ctx, l, map[string][]byte{r: []byte("-1")})
+	if cerr, ok := err.(*CorruptLeafError); !ok {
+		t.Errorf("Map() with a corrupt leaf = %v, want *CorruptLeafError", err)
+	} else if string(cerr.Index) != r {
+		t.Errorf("Map() found leaf %x corrupt, want %x", cerr.Index, r)
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// checkpointInterval is how often, in blocks, File records where a block starts in the
+// file, so that it can get back to a block without decoding everything before it.
+const checkpointInterval = 1024
+
+// recentBlocks is how many of the blocks it has decoded File keeps, so that blocks
+// fetched a little out of order by concurrent workers don't have to be decoded again.
+const recentBlocks = 256
+
+// File is a BlockSource which replays a fixed sequence of consecutive blocks, such as
+// those written by "geth export". The file is checked from end to end when it's opened,
+// but after that blocks are decoded as they're asked for, so it needn't fit in memory.
+// Reading blocks in order is fastest.
+type File struct {
+	open   func() (io.ReadCloser, error)
+	first  uint64
+	latest *types.Block
+	// checkpoints[i] is the offset of block first+i*checkpointInterval in the stream
+	// returned by open.
+	checkpoints []int64
+
+	// mu guards the fields below, which track where File has got to in the stream.
+	mu     sync.Mutex
+	rc     io.ReadCloser
+	s      *rlp.Stream
+	next   uint64
+	recent map[uint64]*types.Block
+}
+
+// NewFile opens the file of RLP encoded blocks at path. As with "geth import", the
+// file is decompressed first if its name ends in ".gz".
+func NewFile(path string) (*File, error) {
+	return newFile(func() (io.ReadCloser, error) {
+		fh, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(path, ".gz") {
+			return fh, nil
+		}
+		zr, err := gzip.NewReader(fh)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		return gzipFile{zr, fh}, nil
+	})
+}
+
+// NewBlocks returns a File which serves the given consecutive blocks.
+func NewBlocks(blocks []*types.Block) (*File, error) {
+	var buf bytes.Buffer
+	for _, b := range blocks {
+		if err := b.EncodeRLP(&buf); err != nil {
+			return nil, err
+		}
+	}
+	raw := buf.Bytes()
+	return newFile(func() (io.ReadCloser, error) {
+		return bytesFile{bytes.NewReader(raw)}, nil
+	})
+}
+
+// gzipFile closes the file underneath a gzip.Reader along with the reader.
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// bytesFile is a seekable in-memory file.
+type bytesFile struct {
+	*bytes.Reader
+}
+
+func (bytesFile) Close() error {
+	return nil
+}
+
+// countingReader keeps track of how far an rlp.Stream has read. Being an io.ByteReader
+// stops the stream adding its own buffering, which would read ahead.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// newFile reads the stream returned by open from end to end, checking that the blocks
+// are consecutive and noting where the checkpoints are.
+func newFile(open func() (io.ReadCloser, error)) (*File, error) {
+	rc, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	f := &File{open: open}
+	cr := &countingReader{r: bufio.NewReader(rc)}
+	s := rlp.NewStream(cr, 0)
+	var prev *types.Block
+	for i := uint64(0); ; i++ {
+		off := cr.n
+		b := &types.Block{}
+		if err := s.Decode(b); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to decode block %d: %v", i, err)
+		}
+		if prev == nil {
+			f.first = b.NumberU64()
+		} else {
+			if want := prev.NumberU64() + 1; b.NumberU64() != want {
+				return nil, fmt.Errorf("got block %d, expected %d", b.NumberU64(), want)
+			}
+			if b.ParentHash() != prev.Hash() {
+				return nil, fmt.Errorf("block %d does not follow block %d", b.NumberU64(), prev.NumberU64())
+			}
+		}
+		if i%checkpointInterval == 0 {
+			f.checkpoints = append(f.checkpoints, off)
+		}
+		prev = b
+	}
+	if prev == nil {
+		return nil, fmt.Errorf("no blocks")
+	}
+	f.latest = prev
+	return f, nil
+}
+
+// seek gets the stream ready to decode the blocks from the checkpoint at or before
+// block n.
+func (f *File) seek(n uint64) error {
+	c := (n - f.first) / checkpointInterval
+	off := f.checkpoints[c]
+	if f.rc != nil {
+		f.rc.Close()
+		f.rc = nil
+	}
+	rc, err := f.open()
+	if err != nil {
+		return err
+	}
+	if sk, ok := rc.(io.Seeker); ok {
+		_, err = sk.Seek(off, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, rc, off)
+	}
+	if err != nil {
+		rc.Close()
+		return fmt.Errorf("failed to seek to block %d: %v", f.first+c*checkpointInterval, err)
+	}
+	f.rc = rc
+	f.s = rlp.NewStream(&countingReader{r: bufio.NewReader(rc), n: off}, 0)
+	f.next = f.first + c*checkpointInterval
+	f.recent = make(map[uint64]*types.Block)
+	return nil
+}
+
+func (f *File) block(number *big.Int) (*types.Block, error) {
+	if number == nil {
+		return f.latest, nil
+	}
+	if !number.IsUint64() {
+		return nil, ethereum.NotFound
+	}
+	n := number.Uint64()
+	if n < f.first || n > f.latest.NumberU64() {
+		return nil, ethereum.NotFound
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if b, ok := f.recent[n]; ok {
+		return b, nil
+	}
+	// Go back to a checkpoint if n has already gone by, or if it's quicker than
+	// decoding everything up to n.
+	if f.s == nil || n < f.next || (n-f.first)/checkpointInterval > (f.next-f.first)/checkpointInterval {
+		if err := f.seek(n); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		b := &types.Block{}
+		if err := f.s.Decode(b); err != nil {
+			f.s = nil
+			return nil, fmt.Errorf("failed to decode block %d: %v", f.next, err)
+		}
+		if b.NumberU64() != f.next {
+			f.s = nil
+			return nil, fmt.Errorf("got block %d, expected %d: has the file changed?", b.NumberU64(), f.next)
+		}
+		f.recent[f.next] = b
+		if f.next >= recentBlocks {
+			delete(f.recent, f.next-recentBlocks)
+		}
+		f.next++
+		if b.NumberU64() == n {
+			return b, nil
+		}
+	}
+}
+
+// BlockByNumber implements BlockSource.
+func (f *File) BlockByNumber(_ context.Context, number *big.Int) (*types.Block, error) {
+	return f.block(number)
+}
+
+// HeaderByNumber implements BlockSource.
+func (f *File) HeaderByNumber(_ context.Context, number *big.Int) (*types.Header, error) {
+	b, err := f.block(number)
+	if err != nil {
+		return nil, err
+	}
+	return b.Header(), nil
+}
+
+// SyncProgress implements BlockSource. The whole file is always available.
+func (f *File) SyncProgress(_ context.Context) (*ethereum.SyncProgress, error) {
+	last := f.latest.NumberU64()
+	return &ethereum.SyncProgress{StartingBlock: f.first, CurrentBlock: last, HighestBlock: last}, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/google/trillian-examples/etherslurp/testonly"
+)
+
+func writeBlocks(t *testing.T, path string, blocks []*types.Block, compress bool) {
+	t.Helper()
+	fh, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	var w io.Writer = fh
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(fh)
+		w = zw
+	}
+	for _, b := range blocks {
+		if err := b.EncodeRLP(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	ctx := context.Background()
+	const first, n = 10, 3*checkpointInterval + 5
+	blocks := testonly.Chain(first, n, nil)
+
+	dir, err := ioutil.TempDir("", "file_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"blocks.rlp", "blocks.rlp.gz"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			writeBlocks(t, path, blocks, filepath.Ext(name) == ".gz")
+			f, err := NewFile(path)
+			if err != nil {
+				t.Fatalf("NewFile(): %v", err)
+			}
+
+			p, err := f.SyncProgress(ctx)
+			if err != nil {
+				t.Fatalf("SyncProgress(): %v", err)
+			}
+			if p.StartingBlock != first || p.CurrentBlock != first+n-1 {
+				t.Errorf("SyncProgress() = %+v, want blocks %d to %d", p, first, first+n-1)
+			}
+
+			// In order, backwards across a checkpoint, jumping ahead, and a little
+			// out of order as concurrent workers would ask.
+			var order []uint64
+			for i := uint64(0); i < checkpointInterval+10; i++ {
+				order = append(order, i)
+			}
+			order = append(order, 3, checkpointInterval-1, 3*checkpointInterval+4, 2*checkpointInterval+1, 2*checkpointInterval, 2*checkpointInterval+3, 2*checkpointInterval+2)
+			for _, i := range order {
+				b, err := f.BlockByNumber(ctx, new(big.Int).SetUint64(first+i))
+				if err != nil {
+					t.Fatalf("BlockByNumber(%d): %v", first+i, err)
+				}
+				if got, want := b.Hash(), blocks[i].Hash(); got != want {
+					t.Fatalf("BlockByNumber(%d) has hash %x, want %x", first+i, got, want)
+				}
+			}
+
+			h, err := f.HeaderByNumber(ctx, nil)
+			if err != nil {
+				t.Fatalf("HeaderByNumber(nil): %v", err)
+			}
+			if got, want := h.Hash(), blocks[n-1].Hash(); got != want {
+				t.Errorf("HeaderByNumber(nil) has hash %x, want %x", got, want)
+			}
+
+			for _, num := range []uint64{first - 1, first + n} {
+				if _, err := f.BlockByNumber(ctx, new(big.Int).SetUint64(num)); err != ethereum.NotFound {
+					t.Errorf("BlockByNumber(%d): %v, want NotFound", num, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewBlocks(t *testing.T) {
+	blocks := testonly.Chain(0, 5, nil)
+	if _, err := NewBlocks(blocks); err != nil {
+		t.Errorf("NewBlocks(): %v", err)
+	}
+	if _, err := NewBlocks(nil); err == nil {
+		t.Error("NewBlocks(nil): no error")
+	}
+	if _, err := NewBlocks(append(blocks[:2:2], blocks[3:]...)); err == nil {
+		t.Error("NewBlocks() with a gap: no error")
+	}
+	other := testonly.Chain(2, 1, nil)
+	if _, err := NewBlocks(append(blocks[:2:2], other...)); err == nil {
+		t.Error("NewBlocks() with the wrong parent: no error")
+	}
+}
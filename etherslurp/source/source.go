@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package source provides the sources of Ethereum blocks that etherslurp can read.
+package source
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// BlockSource provides access to the blocks of an Ethereum chain.
+type BlockSource interface {
+	// BlockByNumber returns the block with the given number, or the latest block if
+	// number is nil.
+	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+	// HeaderByNumber returns the header of the block with the given number, or of the
+	// latest block if number is nil.
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	// SyncProgress returns how far the source has got. CurrentBlock is the number of
+	// the latest block available.
+	SyncProgress(ctx context.Context) (*ethereum.SyncProgress, error)
+}
+
+// ReceiptSource provides access to the receipts of transactions on an Ethereum chain.
+type ReceiptSource interface {
+	// TransactionReceipt returns the receipt for the transaction with the given hash.
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+}
+
+// NetworkSource can report which Ethereum network it's part of.
+type NetworkSource interface {
+	// NetworkID returns the network's chain ID.
+	NetworkID(ctx context.Context) (*big.Int, error)
+}
+
+// ethSource is a BlockSource, ReceiptSource and NetworkSource backed by a geth RPC server.
+type ethSource struct {
+	*ethclient.Client
+}
+
+// NewEthClient returns a BlockSource which reads blocks from geth using gc. It is also a
+// ReceiptSource and a NetworkSource.
+func NewEthClient(gc *ethclient.Client) BlockSource {
+	return ethSource{gc}
+}
+
+// SyncProgress returns geth's sync progress. geth reports no progress at all once it
+// has caught up with the network, in which case its latest block is used instead.
+func (s ethSource) SyncProgress(ctx context.Context) (*ethereum.SyncProgress, error) {
+	p, err := s.Client.SyncProgress(ctx)
+	if err != nil || p != nil {
+		return p, err
+	}
+	h, err := s.Client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	n := h.Number.Uint64()
+	return &ethereum.SyncProgress{CurrentBlock: n, HighestBlock: n}, nil
+}
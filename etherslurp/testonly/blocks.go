@@ -0,0 +1,66 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testonly holds helpers for tests of the etherslurp packages.
+package testonly
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Header returns a header for block num, which can then be changed before the block
+// is made.
+func Header(num uint64) *types.Header {
+	return &types.Header{Number: new(big.Int).SetUint64(num), Difficulty: big.NewInt(1), GasLimit: 8000000}
+}
+
+// Chain returns n consecutive blocks numbered from first, each the child of the one
+// before. fill, if not nil, is called with each header before its block is made, and
+// may set anything but its number and parent.
+func Chain(first uint64, n int, fill func(h *types.Header)) []*types.Block {
+	var blocks []*types.Block
+	var parent *types.Block
+	for i := 0; i < n; i++ {
+		h := Header(first + uint64(i))
+		if parent != nil {
+			h.ParentHash = parent.Hash()
+		}
+		if fill != nil {
+			fill(h)
+		}
+		b := types.NewBlockWithHeader(h)
+		blocks = append(blocks, b)
+		parent = b
+	}
+	return blocks
+}
+
+// Block returns a block with header h holding txs, which are signed by key with the
+// signer config uses at h's number.
+func Block(config *params.ChainConfig, h *types.Header, key *ecdsa.PrivateKey, txs ...*types.Transaction) (*types.Block, error) {
+	signer := types.MakeSigner(config, h.Number)
+	signed := make([]*types.Transaction, 0, len(txs))
+	for _, tx := range txs {
+		stx, err := types.SignTx(tx, signer, key)
+		if err != nil {
+			return nil, err
+		}
+		signed = append(signed, stx)
+	}
+	return types.NewBlock(h, signed, nil, nil), nil
+}
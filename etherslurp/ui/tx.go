@@ -0,0 +1,187 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ui
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/blockleaf"
+	"github.com/google/trillian-examples/etherslurp/mapper"
+	"github.com/google/trillian/merkle"
+	"github.com/google/trillian/merkle/maphasher"
+	"github.com/google/trillian/types"
+)
+
+// txInfo is what the UI shows about a transaction: its entry in the transaction map
+// with a proof of that against the map root, and the block holding it with a proof of
+// that against the log root.
+type txInfo struct {
+	TxHash    string
+	ErrorText string
+	Entry     *mapper.TxEntry
+	Amount    string
+	To        string
+
+	MapProofValid bool
+	MapProofDesc  string
+	MapProof      string
+	SMR           string
+
+	LogProofValid bool
+	LogProofDesc  string
+	LogProof      string
+	SLR           string
+}
+
+// verifyMapLeaf checks the map inclusion proof inc against the map root smr.
+func (ui *UI) verifyMapLeaf(inc *trillian.MapLeafInclusion, smr *trillian.SignedMapRoot) error {
+	var root types.MapRootV1
+	if err := root.UnmarshalBinary(smr.MapRoot); err != nil {
+		return err
+	}
+	return merkle.VerifyMapInclusionProof(ui.opts.TxMapID, inc.Leaf.Index, inc.Leaf.LeafValue, root.RootHash, inc.Inclusion, maphasher.Default)
+}
+
+// logRoot returns the latest log root, checking its signature if the UI has the log's
+// public key.
+func (ui *UI) logRoot(ctx context.Context) (*trillian.SignedLogRoot, *types.LogRootV1, error) {
+	rsp, err := ui.opts.Log.GetLatestSignedLogRoot(ctx, &trillian.GetLatestSignedLogRootRequest{LogId: ui.opts.LogID})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get log root: %v", err)
+	}
+	slr := rsp.SignedLogRoot
+	if ui.opts.LogPublicKey != nil {
+		root, err := ui.logVerifier.VerifyRoot(&types.LogRootV1{}, slr, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad log root: %v", err)
+		}
+		return slr, root, nil
+	}
+	var root types.LogRootV1
+	if err := root.UnmarshalBinary(slr.LogRoot); err != nil {
+		return nil, nil, err
+	}
+	return slr, &root, nil
+}
+
+// verifyBlock checks that the log leaf at e.LogIndex holds the transaction with hash h
+// at e.Index, and that the leaf is included under root.
+func (ui *UI) verifyBlock(ctx context.Context, h common.Hash, e *mapper.TxEntry, root *types.LogRootV1) (*trillian.Proof, error) {
+	if uint64(e.LogIndex) >= root.TreeSize {
+		return nil, fmt.Errorf("log index %d is beyond the log root's tree size %d", e.LogIndex, root.TreeSize)
+	}
+	leaves, err := ui.opts.Log.GetLeavesByIndex(ctx, &trillian.GetLeavesByIndexRequest{LogId: ui.opts.LogID, LeafIndex: []int64{e.LogIndex}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get log leaf %d: %v", e.LogIndex, err)
+	}
+	if len(leaves.Leaves) != 1 {
+		return nil, fmt.Errorf("got %d log leaves, expected 1", len(leaves.Leaves))
+	}
+	l, err := blockleaf.Decode(leaves.Leaves[0].LeafValue)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode log leaf %d: %v", e.LogIndex, err)
+	}
+	if l.Block == nil {
+		return nil, fmt.Errorf("log leaf %d holds only a header", e.LogIndex)
+	}
+	if l.Block.Number().Int64() != e.Block {
+		return nil, fmt.Errorf("log leaf %d holds block %v, not %d", e.LogIndex, l.Block.Number(), e.Block)
+	}
+	txs := l.Block.Transactions()
+	if e.Index >= len(txs) || txs[e.Index].Hash() != h {
+		return nil, fmt.Errorf("block %d doesn't hold the transaction at index %d", e.Block, e.Index)
+	}
+
+	proof, err := ui.opts.Log.GetInclusionProof(ctx, &trillian.GetInclusionProofRequest{
+		LogId:     ui.opts.LogID,
+		LeafIndex: e.LogIndex,
+		TreeSize:  int64(root.TreeSize),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get log inclusion proof: %v", err)
+	}
+	if err := ui.logVerifier.VerifyInclusionAtIndex(root, leaves.Leaves[0].LeafValue, e.LogIndex, proof.Proof.Hashes); err != nil {
+		return proof.Proof, err
+	}
+	return proof.Proof, nil
+}
+
+// lookupTx fills in a txInfo for the transaction with hash tx.
+func (ui *UI) lookupTx(ctx context.Context, tx string) *txInfo {
+	info := &txInfo{TxHash: tx}
+	if ui.opts.TxMapID == 0 || ui.opts.Log == nil {
+		info.ErrorText = "Transaction search isn't enabled"
+		return info
+	}
+	h := common.HexToHash(strings.TrimPrefix(tx, "0x"))
+
+	get, err := ui.tmc.GetLeaves(ctx, &trillian.GetMapLeavesRequest{MapId: ui.opts.TxMapID, Index: [][]byte{mapper.TxIndex(h)}})
+	if err != nil {
+		info.ErrorText = fmt.Sprintf("failed to look up tx %s: %v", tx, err)
+		return info
+	}
+	if len(get.MapLeafInclusion) != 1 {
+		info.ErrorText = fmt.Sprintf("got %d map leaves for tx %s, expected 1", len(get.MapLeafInclusion), tx)
+		return info
+	}
+	inc := get.MapLeafInclusion[0]
+	info.SMR = jsonOrErr(get.MapRoot)
+	info.MapProof = jsonOrErr(inc.Inclusion)
+	if err := ui.verifyMapLeaf(inc, get.MapRoot); err != nil {
+		info.MapProofDesc = fmt.Sprintf("INVALID: %s", err)
+	} else {
+		info.MapProofValid = true
+		info.MapProofDesc = "VALID"
+	}
+	if len(inc.Leaf.LeafValue) == 0 {
+		info.ErrorText = fmt.Sprintf("Transaction %s has not been logged", tx)
+		return info
+	}
+
+	var e mapper.TxEntry
+	if err := json.Unmarshal(inc.Leaf.LeafValue, &e); err != nil {
+		info.ErrorText = fmt.Sprintf("Couldn't parse transaction entry %s", inc.Leaf.LeafValue)
+		return info
+	}
+	info.Entry = &e
+	info.Amount = ethBalance(e.Value)
+	info.To = "new contract"
+	if e.To != nil {
+		info.To = e.To.Hex()
+	}
+
+	slr, root, err := ui.logRoot(ctx)
+	if err != nil {
+		info.LogProofDesc = fmt.Sprintf("ERROR: %s", err)
+		return info
+	}
+	info.SLR = jsonOrErr(slr)
+	proof, err := ui.verifyBlock(ctx, h, &e, root)
+	if proof != nil {
+		info.LogProof = jsonOrErr(proof)
+	}
+	if err != nil {
+		info.LogProofDesc = fmt.Sprintf("INVALID: %s", err)
+	} else {
+		info.LogProofValid = true
+		info.LogProofDesc = fmt.Sprintf("VALID at tree size %d", root.TreeSize)
+	}
+	return info
+}
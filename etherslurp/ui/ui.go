@@ -16,6 +16,7 @@ package ui
 
 import (
 	"context"
+	"crypto"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -27,8 +28,10 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/google/trillian"
+	"github.com/google/trillian/client"
 	"github.com/google/trillian/merkle"
 	"github.com/google/trillian/merkle/maphasher"
+	"github.com/google/trillian/merkle/rfc6962"
 	"github.com/google/trillian/types"
 )
 
@@ -41,7 +44,54 @@ const page = `
 	<form method="get">
 		AccountID: <input type="text" name="account"/><input type="submit" value="Go!"/>
 	</form>
+	<form method="get">
+		Transaction: <input type="text" name="tx"/><input type="submit" value="Go!"/>
+	</form>
+	{{if .Tx}}
+	{{with .Tx}}
+	Transaction <i>{{.TxHash}}</i><br/>
+	{{if .Entry}}
+	Block <i>{{.Entry.Block}}</i>, index <i>{{.Entry.Index}}</i>, log leaf <i>{{.Entry.LogIndex}}</i><br/>
+	From <i>{{.Entry.From.Hex}}</i> to <i>{{.To}}</i><br/>
+	Value <i>{{.Amount}}</i><br/>
+	{{end}}
 	{{if .ErrorText}}
+		<font color="darkred">{{.ErrorText}}</font><br/>
+	{{end}}
+	<br/>
+	Map Inclusion Proof is
+	{{if .MapProofValid}}
+	  <font color="green">{{.MapProofDesc}}</font>
+	{{else}}
+	  <font color="red">{{.MapProofDesc}}</font>
+	{{end}}
+	<br/>
+	{{if .Entry}}
+	Log Inclusion Proof is
+	{{if .LogProofValid}}
+	  <font color="green">{{.LogProofDesc}}</font>
+	{{else}}
+	  <font color="red">{{.LogProofDesc}}</font>
+	{{end}}
+	<br/>
+	{{end}}
+	<br/>
+	SMR:<br/>
+	<pre>{{.SMR}}</pre>
+	</br>
+	MapInclusionProof:<br/>
+	<pre>{{.MapProof}}</pre>
+	<br/>
+	{{if .Entry}}
+	SLR:<br/>
+	<pre>{{.SLR}}</pre>
+	</br>
+	LogInclusionProof:<br/>
+	<pre>{{.LogProof}}</pre>
+	<br/>
+	{{end}}
+	{{end}}
+	{{else if .ErrorText}}
 		<font color="darkred">{{.ErrorText}}</font>
 	{{else if .AccountID}}
 	Account <i>{{.AccountID}}</i><br/>
@@ -78,23 +128,43 @@ const (
 
 var oneEtherRatio = big.NewFloat(float64(1) / float64(oneEther))
 
+// Opts encapsulates the options that can be used with a UI.
+type Opts struct {
+	// TxMapID, if set, is the map of transactions built by mapper.TxLookup, which
+	// enables transaction search. Log and LogID must also be set.
+	TxMapID int64
+	// Log and LogID are the log of blocks, used to prove that a transaction has been
+	// logged.
+	Log   trillian.TrillianLogClient
+	LogID int64
+	// LogPublicKey, if set, is used to verify the signature on the log root.
+	LogPublicKey crypto.PublicKey
+}
+
 // New creates a new UI.
-func New(tmc trillian.TrillianMapClient, mapID int64) *UI {
+func New(tmc trillian.TrillianMapClient, mapID int64, opts Opts) *UI {
 	return &UI{
-		mapID: mapID,
-		tmc:   tmc,
-		tmpl:  template.Must(template.New("root").Parse(page)),
+		mapID:       mapID,
+		tmc:         tmc,
+		opts:        opts,
+		logVerifier: client.NewLogVerifier(rfc6962.DefaultHasher, opts.LogPublicKey, crypto.SHA256),
+		tmpl:        template.Must(template.New("root").Parse(page)),
 	}
 }
 
 // UI encapsulates data related to serving the web ui for the application.
 type UI struct {
-	mapID int64
-	tmc   trillian.TrillianMapClient
-	tmpl  *template.Template
+	mapID       int64
+	tmc         trillian.TrillianMapClient
+	opts        Opts
+	logVerifier *client.LogVerifier
+	tmpl        *template.Template
 }
 
-const keyAccount = "account"
+const (
+	keyAccount = "account"
+	keyTx      = "tx"
+)
 
 type accountInfo struct {
 	AccountID  string
@@ -104,6 +174,7 @@ type accountInfo struct {
 	ProofDesc  string
 	Proof      string
 	SMR        string
+	Tx         *txInfo
 }
 
 func index(a []byte) []byte {
@@ -151,7 +222,9 @@ func (ui *UI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	acString := req.FormValue(keyAccount)
 
 	var ac accountInfo
-	if acString != "" {
+	if tx := req.FormValue(keyTx); tx != "" {
+		ac.Tx = ui.lookupTx(req.Context(), tx)
+	} else if acString != "" {
 		ac.AccountID = acString
 		leafInc, smr, err := ui.getLeaf(req.Context(), acString)
 		if err != nil {
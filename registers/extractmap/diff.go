@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/registers/records"
+	"github.com/google/trillian/merkle"
+	"github.com/google/trillian/merkle/maphasher"
+	"github.com/google/trillian/types"
+)
+
+// Kinds of change between two revisions of a record.
+const (
+	changeAdded    = "added"
+	changeRemoved  = "removed"
+	changeReplaced = "replaced"
+	changeMerged   = "merged"
+)
+
+// recordAt is a record as it was at one map revision, with the proof
+// of its value at that revision.
+type recordAt struct {
+	LogIndex int64           `json:",omitempty"`
+	Record   *records.Record `json:",omitempty"`
+	Proof    *trillian.MapLeafInclusion
+}
+
+type change struct {
+	Key    string
+	Change string
+	A, B   recordAt
+}
+
+type mapDiff struct {
+	MapID     int64
+	RevisionA int64
+	RevisionB int64
+	MapRootA  *trillian.SignedMapRoot
+	MapRootB  *trillian.SignedMapRoot
+	Changes   []change
+	Unchanged int
+}
+
+// parseRange parses a revision range of the form "A..B".
+func parseRange(s string) (int64, int64, error) {
+	ab := strings.SplitN(s, "..", 2)
+	if len(ab) != 2 {
+		return 0, 0, fmt.Errorf("bad revision range %q, want A..B", s)
+	}
+	a, err := strconv.ParseInt(ab[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := strconv.ParseInt(ab[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if a > b {
+		return 0, 0, fmt.Errorf("revision %d is after %d", a, b)
+	}
+	return a, b, nil
+}
+
+// verifyProof checks that inc is a valid proof against the map root smr.
+func verifyProof(smr *trillian.SignedMapRoot, inc *trillian.MapLeafInclusion) error {
+	var root types.MapRootV1
+	if err := root.UnmarshalBinary(smr.MapRoot); err != nil {
+		return err
+	}
+	return merkle.VerifyMapInclusionProof(*mapID, inc.Leaf.Index, inc.Leaf.LeafValue, root.RootHash, inc.Inclusion, maphasher.Default)
+}
+
+// getMapRoot fetches the signed map root at revision rev.
+func getMapRoot(tmc trillian.TrillianMapClient, rev int64) (*trillian.SignedMapRoot, error) {
+	resp, err := tmc.GetSignedMapRootByRevision(context.Background(), &trillian.GetSignedMapRootByRevisionRequest{MapId: *mapID, Revision: rev})
+	if err != nil {
+		return nil, fmt.Errorf("can't get map root at revision %d: %v", rev, err)
+	}
+	return resp.MapRoot, nil
+}
+
+// getRecordAt fetches the record for k at revision rev, and checks its
+// proof against smr, the map root at that revision.
+func getRecordAt(tmc trillian.TrillianMapClient, smr *trillian.SignedMapRoot, rev int64, k string) (recordAt, error) {
+	inc, _, err := records.GetLeafByRevision(tmc, *mapID, rev, records.RecordHash(k))
+	if err != nil {
+		return recordAt{}, err
+	}
+	if err := verifyProof(smr, inc); err != nil {
+		return recordAt{}, fmt.Errorf("bad proof for record %q at revision %d: %v", k, rev, err)
+	}
+	ra := recordAt{Proof: inc}
+	if len(inc.Leaf.LeafValue) == 0 {
+		return ra, nil
+	}
+	var r records.Record
+	if err := json.Unmarshal(inc.Leaf.LeafValue, &r); err != nil {
+		return recordAt{}, fmt.Errorf("can't unmarshal record %q at revision %d: %v", k, rev, err)
+	}
+	ra.Record = &r
+	ra.LogIndex = r.LogIndex
+	return ra, nil
+}
+
+// diffRevisions compares every record in the map at revisions a and b,
+// checking the proof of each record at both. Keys are never removed
+// from the map, so walking the keys at b covers every record present
+// at a.
+func diffRevisions(tmc trillian.TrillianMapClient, a, b int64) (*mapDiff, error) {
+	d := &mapDiff{MapID: *mapID, RevisionA: a, RevisionB: b}
+	var err error
+	if d.MapRootA, err = getMapRoot(tmc, a); err != nil {
+		return nil, err
+	}
+	if d.MapRootB, err = getMapRoot(tmc, b); err != nil {
+		return nil, err
+	}
+	for n := 0; ; n++ {
+		inc, _, err := records.GetLeafByRevision(tmc, *mapID, b, records.KeyHash(n))
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyProof(d.MapRootB, inc); err != nil {
+			return nil, fmt.Errorf("bad proof for key %d at revision %d: %v", n, b, err)
+		}
+		if len(inc.Leaf.LeafValue) == 0 {
+			break
+		}
+		k := string(inc.Leaf.LeafValue)
+
+		ra, err := getRecordAt(tmc, d.MapRootA, a, k)
+		if err != nil {
+			return nil, err
+		}
+		rb, err := getRecordAt(tmc, d.MapRootB, b, k)
+		if err != nil {
+			return nil, err
+		}
+
+		c := change{Key: k, A: ra, B: rb}
+		switch {
+		case ra.Record == nil && rb.Record == nil:
+			d.Unchanged++
+			continue
+		case ra.Record == nil:
+			c.Change = changeAdded
+		case rb.Record == nil, rb.Record.Tombstone && !ra.Record.Tombstone:
+			c.Change = changeRemoved
+		case ra.LogIndex != rb.LogIndex || !reflect.DeepEqual(ra.Record.Entry, rb.Record.Entry):
+			c.Change = changeReplaced
+		case !reflect.DeepEqual(ra.Record.Items, rb.Record.Items):
+			c.Change = changeMerged
+		default:
+			d.Unchanged++
+			continue
+		}
+		d.Changes = append(d.Changes, c)
+	}
+	return d, nil
+}
+
+func writeDiff(w io.Writer, d *mapDiff, format string) error {
+	switch format {
+	case "json":
+		j, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(j)
+		return err
+	case "text":
+		fmt.Fprintf(w, "Map %d, revision %d..%d\n", d.MapID, d.RevisionA, d.RevisionB)
+		for _, c := range d.Changes {
+			switch c.Change {
+			case changeAdded:
+				fmt.Fprintf(w, "%-8s %s (log index %d)\n", c.Change, c.Key, c.B.LogIndex)
+			case changeRemoved, changeReplaced:
+				fmt.Fprintf(w, "%-8s %s (log index %d -> %d)\n", c.Change, c.Key, c.A.LogIndex, c.B.LogIndex)
+			case changeMerged:
+				fmt.Fprintf(w, "%-8s %s (log index %d, %d -> %d items)\n", c.Change, c.Key, c.B.LogIndex, len(c.A.Record.Items), len(c.B.Record.Items))
+			}
+		}
+		fmt.Fprintf(w, "%d changed, %d unchanged\n", len(d.Changes), d.Unchanged)
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
@@ -4,15 +4,22 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/google/trillian"
 	"github.com/google/trillian-examples/registers/records"
+	"github.com/google/trillian-examples/registers/snapshot"
 	"google.golang.org/grpc"
 )
 
 var (
 	trillianMap = flag.String("trillian_map", "localhost:8095", "address of the Trillian Map RPC server.")
 	mapID       = flag.Int64("map_id", 0, "Trillian MapID to read.")
+	snap        = flag.Bool("snapshot", false, "write a verifiable snapshot of the map to --out rather than printing records.")
+	revision    = flag.Int64("revision", -1, "map revision to snapshot, or -1 for the latest.")
+	outDir      = flag.String("out", "snapshot", "directory to write the snapshot to.")
+	diff        = flag.String("diff", "", "list records changed between two map revisions, given as REV_A..REV_B.")
+	format      = flag.String("format", "text", "output format for --diff, text or json.")
 )
 
 func getRecord(tmc trillian.TrillianMapClient, k string) {
@@ -30,6 +37,30 @@ func main() {
 	}
 	tmc := trillian.NewTrillianMapClient(g)
 
+	if *snap {
+		m, err := snapshot.Write(tmc, *mapID, *revision, *outDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Wrote %d records at revision %d to %s\n", len(m.Records), m.Revision, *outDir)
+		return
+	}
+
+	if *diff != "" {
+		a, b, err := parseRange(*diff)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d, err := diffRevisions(tmc, a, b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeDiff(os.Stdout, d, *format); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if len(flag.Args()) == 0 {
 		for n := 0; ; n++ {
 			resp := records.GetValue(tmc, *mapID, records.KeyHash(n))
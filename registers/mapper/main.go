@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"log"
 	"reflect"
-	"time"
 
 	"github.com/google/trillian"
 	"github.com/google/trillian-examples/registers/records"
@@ -20,15 +19,16 @@ var (
 	logID       = flag.Int64("log_id", 0, "Trillian LogID to read.")
 	trillianMap = flag.String("trillian_map", "localhost:8095", "address of the Trillian Map RPC server.")
 	mapID       = flag.Int64("map_id", 0, "Trillian MapID to write.")
+	mergePolicy = flag.String("merge_policy", "timestamp", "how to merge entries for the same key: timestamp, entry-number or keep-all.")
 )
 
-type record struct {
-	Entry map[string]interface{}
-	Items []map[string]interface{}
-}
-
-// add adds an item. Only adds if the item is not already present in Items.
-func (r *record) add(i map[string]interface{}) {
+// add adds an item to r. Only adds if the item is not already present in Items.
+// An empty item, which removes the record, is never added: policies turn
+// the record into a tombstone instead.
+func add(r *records.Record, i map[string]interface{}) {
+	if len(i) == 0 {
+		return
+	}
 	for _, ii := range r.Items {
 		if reflect.DeepEqual(i, ii) {
 			return
@@ -45,14 +45,38 @@ type mapInfo struct {
 }
 
 func newInfo(tc trillian.TrillianMapClient, mapID int64, ctx context.Context) *mapInfo {
-	// FIXME: need to figure out current keyCount...
 	i := &mapInfo{mapID: mapID, tc: tc, ctx: ctx}
+	// Keys are never removed, so carry on after the last one already in
+	// the map to keep existing key positions stable.
+	i.keyCount = countKeys(func(n int) bool {
+		return records.GetValue(tc, mapID, records.KeyHash(n)) != nil
+	})
+	log.Printf("Map has %d keys", i.keyCount)
 	return i
 }
 
-func (i *mapInfo) createRecord(key string, entry map[string]interface{}, item map[string]interface{}) {
-	ii := [1]map[string]interface{}{item}
-	i.saveRecord(key, &record{Entry: entry, Items: ii[:]})
+// countKeys returns the number of keys in a map, given has, which
+// reports whether there is a key at position n. Keys fill positions from
+// 0 with no gaps, so the count is found by doubling to get past the end
+// and then searching between there and the last key found.
+func countKeys(has func(n int) bool) int {
+	if !has(0) {
+		return 0
+	}
+	lo, hi := 0, 1
+	for has(hi) {
+		lo, hi = hi, hi*2
+	}
+	// has(lo) and !has(hi)
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if has(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi
 }
 
 func (i *mapInfo) addToMap(h []byte, v []byte) {
@@ -88,7 +112,7 @@ func (i *mapInfo) addKey(key string) {
 	i.keyCount++
 }
 
-func (i *mapInfo) getLeaf(key string) (*record, error) {
+func (i *mapInfo) getLeaf(key string) (*records.Record, error) {
 	hash := records.RecordHash(key)
 	index := [1][]byte{hash}
 	req := &trillian.GetMapLeavesRequest{
@@ -108,7 +132,7 @@ func (i *mapInfo) getLeaf(key string) (*record, error) {
 		return nil, nil
 	}
 
-	var r record
+	var r records.Record
 	err = json.Unmarshal(l, &r)
 	if err != nil {
 		return nil, err
@@ -118,7 +142,7 @@ func (i *mapInfo) getLeaf(key string) (*record, error) {
 }
 
 // Get the current record for the given key, possibly going to Trillian to look it up, possibly flushing the cache if needed.
-func (i *mapInfo) get(key string) (*record, error) {
+func (i *mapInfo) get(key string) (*records.Record, error) {
 	r, err := i.getLeaf(key)
 	if err != nil {
 		return nil, err
@@ -130,59 +154,46 @@ func (i *mapInfo) get(key string) (*record, error) {
 }
 
 type logScanner struct {
-	info *mapInfo
+	info   *mapInfo
+	policy MergePolicy
 }
 
 func (s *logScanner) Leaf(leaf *trillian.LogLeaf) error {
-	var l map[string]interface{}
-	if err := json.Unmarshal(leaf.LeafValue, &l); err != nil {
-		return err
-	}
-
-	e := l["Entry"].(map[string]interface{})
-	t, err := time.Parse(time.RFC3339, e["entry-timestamp"].(string))
+	e, err := parseEntry(leaf)
 	if err != nil {
 		return err
 	}
+	log.Printf("k: %s ts: %s", e.Key, e.Timestamp)
 
-	k := e["key"].(string)
-	i := l["Item"].(map[string]interface{})
-	log.Printf("k: %s ts: %s", k, t)
-
-	cr, err := s.info.get(k)
+	cr, err := s.info.get(e.Key)
 	if err != nil {
 		return err
 	}
 	if cr == nil {
-		s.info.createRecord(k, e, i)
-		s.info.addKey(k)
+		s.info.saveRecord(e.Key, newRecord(e))
+		s.info.addKey(e.Key)
 		return nil
 	}
 
-	ct, err := time.Parse(time.RFC3339, cr.Entry["entry-timestamp"].(string))
+	r, err := s.policy.Merge(cr, e)
 	if err != nil {
 		return err
 	}
-
-	if t.Before(ct) {
-		log.Printf("Skip")
-		return nil
-	} else if t.After(ct) {
-		log.Printf("Replace")
-		s.info.createRecord(k, e, i)
-		return nil
+	if r != nil {
+		s.info.saveRecord(e.Key, r)
 	}
 
-	log.Printf("Add")
-	cr.add(i)
-	s.info.saveRecord(k, cr)
-
 	return nil
 }
 
 func main() {
 	flag.Parse()
 
+	p, ok := mergePolicies[*mergePolicy]
+	if !ok {
+		log.Fatalf("Unknown merge policy %q", *mergePolicy)
+	}
+
 	tc := trillian_client.New(*trillianLog)
 	defer tc.Close()
 
@@ -193,7 +204,7 @@ func main() {
 	tmc := trillian.NewTrillianMapClient(g)
 
 	i := newInfo(tmc, *mapID, context.Background())
-	err = tc.Scan(*logID, &logScanner{info: i})
+	err = tc.Scan(*logID, &logScanner{info: i, policy: p})
 	if err != nil {
 		log.Fatal(err)
 	}
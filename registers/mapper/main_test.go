@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestCountKeys(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 7, 8, 9, 100, 1023, 1024, 1025} {
+		calls := 0
+		got := countKeys(func(i int) bool {
+			calls++
+			if i < 0 {
+				t.Fatalf("has(%d) called", i)
+			}
+			return i < n
+		})
+		if got != n {
+			t.Errorf("countKeys() with %d keys = %d", n, got)
+		}
+		if calls > 25 {
+			t.Errorf("countKeys() with %d keys looked up %d keys", n, calls)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/registers/records"
+)
+
+// entry is a single entry and item read from a log leaf.
+type entry struct {
+	Key       string
+	Number    int64
+	Timestamp time.Time
+	Entry     map[string]interface{}
+	Item      map[string]interface{}
+	LogIndex  int64
+}
+
+// entryNumber extracts the entry number from an entry, which may be
+// serialised as either a string or a number.
+func entryNumber(e map[string]interface{}) (int64, error) {
+	switch n := e["entry-number"].(type) {
+	case string:
+		return strconv.ParseInt(n, 10, 64)
+	case float64:
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("bad entry-number %#v", e["entry-number"])
+}
+
+// entryTimestamp extracts the timestamp from an entry.
+func entryTimestamp(e map[string]interface{}) (time.Time, error) {
+	s, ok := e["entry-timestamp"].(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("bad entry-timestamp %#v", e["entry-timestamp"])
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func parseEntry(leaf *trillian.LogLeaf) (*entry, error) {
+	var l map[string]interface{}
+	if err := json.Unmarshal(leaf.LeafValue, &l); err != nil {
+		return nil, err
+	}
+
+	e, ok := l["Entry"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("leaf %d has no entry", leaf.LeafIndex)
+	}
+	k, ok := e["key"].(string)
+	if !ok {
+		return nil, fmt.Errorf("bad key %#v in leaf %d", e["key"], leaf.LeafIndex)
+	}
+	t, err := entryTimestamp(e)
+	if err != nil {
+		return nil, err
+	}
+	n, err := entryNumber(e)
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries that remove a record have no item.
+	i, _ := l["Item"].(map[string]interface{})
+	return &entry{
+		Key:       k,
+		Number:    n,
+		Timestamp: t,
+		Entry:     e,
+		Item:      i,
+		LogIndex:  leaf.LeafIndex,
+	}, nil
+}
+
+// removes reports whether e removes its record, which is signalled by
+// an empty item.
+func (e *entry) removes() bool {
+	return len(e.Item) == 0
+}
+
+// newRecord creates a record holding just e, or a tombstone if e
+// removes the record.
+func newRecord(e *entry) *records.Record {
+	if e.removes() {
+		return &records.Record{Entry: e.Entry, LogIndex: e.LogIndex, Tombstone: true}
+	}
+	return &records.Record{Entry: e.Entry, Items: []map[string]interface{}{e.Item}, LogIndex: e.LogIndex}
+}
+
+// addEntry adds the item of e, which is another item of the entry cr
+// holds, to cr. The record then stands for e. A tombstone is brought
+// back holding just e's item.
+func addEntry(cr *records.Record, e *entry) *records.Record {
+	if cr.Tombstone {
+		return newRecord(e)
+	}
+	add(cr, e.Item)
+	cr.Entry = e.Entry
+	cr.LogIndex = e.LogIndex
+	return cr
+}
+
+// MergePolicy decides how an entry read from the log is combined with
+// the existing record for its key. Merge returns the new record, or nil
+// if the existing record should be left alone. It may modify cr.
+type MergePolicy interface {
+	Merge(cr *records.Record, e *entry) (*records.Record, error)
+}
+
+// mergePolicies are the policies that can be selected with --merge_policy.
+var mergePolicies = map[string]MergePolicy{
+	"timestamp":    timestampPolicy{},
+	"entry-number": entryNumberPolicy{},
+	"keep-all":     keepAllPolicy{},
+}
+
+// timestampPolicy keeps the entry with the latest timestamp. An entry
+// with the same timestamp as the current one has its item added to the
+// record, or makes it a tombstone if it removes the record.
+type timestampPolicy struct{}
+
+func (timestampPolicy) Merge(cr *records.Record, e *entry) (*records.Record, error) {
+	ct, err := entryTimestamp(cr.Entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Timestamp.Before(ct) {
+		return nil, nil
+	} else if e.Timestamp.After(ct) {
+		return newRecord(e), nil
+	}
+
+	if e.removes() {
+		return newRecord(e), nil
+	}
+	return addEntry(cr, e), nil
+}
+
+// entryNumberPolicy keeps the entry with the highest entry number. An
+// entry with the same number as the current one is another item of the
+// same entry, and is added to the record, or makes it a tombstone if it
+// removes the record.
+type entryNumberPolicy struct{}
+
+func (entryNumberPolicy) Merge(cr *records.Record, e *entry) (*records.Record, error) {
+	cn, err := entryNumber(cr.Entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Number < cn {
+		return nil, nil
+	} else if e.Number > cn {
+		return newRecord(e), nil
+	}
+
+	if e.removes() {
+		return newRecord(e), nil
+	}
+	return addEntry(cr, e), nil
+}
+
+// keepAllPolicy adds every item to the record, and keeps the entry with
+// the highest entry number. An entry removing the record makes it a
+// tombstone unless a later entry has already been seen. A tombstone is
+// brought back by a later item, without the items from before it was
+// removed.
+type keepAllPolicy struct{}
+
+func (keepAllPolicy) Merge(cr *records.Record, e *entry) (*records.Record, error) {
+	cn, err := entryNumber(cr.Entry)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case cr.Tombstone && e.Number < cn:
+		return nil, nil
+	case cr.Tombstone && !e.removes():
+		return newRecord(e), nil
+	case e.Number > cn || e.Number == cn && e.removes():
+		cr.Entry = e.Entry
+		cr.LogIndex = e.LogIndex
+		cr.Tombstone = e.removes()
+	}
+	add(cr, e.Item)
+	return cr, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/registers/records"
+)
+
+// testEntry builds an entry for key "k" with the given number, timestamp
+// and item, as parseEntry would.
+func testEntry(t *testing.T, n int64, ts string, item map[string]interface{}) *entry {
+	t.Helper()
+	tm, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &entry{
+		Key:       "k",
+		Number:    n,
+		Timestamp: tm,
+		Entry:     map[string]interface{}{"key": "k", "entry-number": float64(n), "entry-timestamp": ts},
+		Item:      item,
+		LogIndex:  n,
+	}
+}
+
+func item(name string) map[string]interface{} {
+	return map[string]interface{}{"name": name}
+}
+
+func TestMergePolicies(t *testing.T) {
+	const (
+		t1 = "2018-01-01T00:00:00Z"
+		t2 = "2018-01-02T00:00:00Z"
+	)
+	for _, tc := range []struct {
+		desc   string
+		policy string
+		cur    *entry
+		// curItems are items kept in the current record, as a keep-all
+		// tombstone does.
+		curItems []map[string]interface{}
+		e        *entry
+		want     *records.Record // nil means the record is left alone
+		wantErr  bool
+	}{
+		{
+			desc:   "timestamp later replaces",
+			policy: "timestamp",
+			cur:    testEntry(t, 1, t1, item("a")),
+			e:      testEntry(t, 2, t2, item("b")),
+			want:   &records.Record{Entry: testEntry(t, 2, t2, nil).Entry, Items: []map[string]interface{}{item("b")}, LogIndex: 2},
+		},
+		{
+			desc:   "timestamp out of order is skipped",
+			policy: "timestamp",
+			cur:    testEntry(t, 2, t2, item("b")),
+			e:      testEntry(t, 1, t1, item("a")),
+		},
+		{
+			desc:   "timestamp same second adds item",
+			policy: "timestamp",
+			cur:    testEntry(t, 1, t1, item("a")),
+			e:      testEntry(t, 2, t1, item("b")),
+			want:   &records.Record{Entry: testEntry(t, 2, t1, nil).Entry, Items: []map[string]interface{}{item("a"), item("b")}, LogIndex: 2},
+		},
+		{
+			desc:   "timestamp same second duplicate item",
+			policy: "timestamp",
+			cur:    testEntry(t, 1, t1, item("a")),
+			e:      testEntry(t, 2, t1, item("a")),
+			want:   &records.Record{Entry: testEntry(t, 2, t1, nil).Entry, Items: []map[string]interface{}{item("a")}, LogIndex: 2},
+		},
+		{
+			desc:   "timestamp later removal",
+			policy: "timestamp",
+			cur:    testEntry(t, 1, t1, item("a")),
+			e:      testEntry(t, 2, t2, nil),
+			want:   &records.Record{Entry: testEntry(t, 2, t2, nil).Entry, LogIndex: 2, Tombstone: true},
+		},
+		{
+			desc:   "timestamp same second removal",
+			policy: "timestamp",
+			cur:    testEntry(t, 1, t1, item("a")),
+			e:      testEntry(t, 2, t1, nil),
+			want:   &records.Record{Entry: testEntry(t, 2, t1, nil).Entry, LogIndex: 2, Tombstone: true},
+		},
+		{
+			desc:   "timestamp same second add after removal",
+			policy: "timestamp",
+			cur:    testEntry(t, 1, t1, nil),
+			e:      testEntry(t, 2, t1, item("b")),
+			want:   &records.Record{Entry: testEntry(t, 2, t1, nil).Entry, Items: []map[string]interface{}{item("b")}, LogIndex: 2},
+		},
+		{
+			desc:   "entry number higher replaces",
+			policy: "entry-number",
+			cur:    testEntry(t, 1, t2, item("a")),
+			e:      testEntry(t, 2, t1, item("b")),
+			want:   &records.Record{Entry: testEntry(t, 2, t1, nil).Entry, Items: []map[string]interface{}{item("b")}, LogIndex: 2},
+		},
+		{
+			desc:   "entry number out of order is skipped",
+			policy: "entry-number",
+			cur:    testEntry(t, 2, t1, item("b")),
+			e:      testEntry(t, 1, t2, item("a")),
+		},
+		{
+			desc:   "entry number same adds item",
+			policy: "entry-number",
+			cur:    testEntry(t, 1, t1, item("a")),
+			e:      testEntry(t, 1, t1, item("b")),
+			want:   &records.Record{Entry: testEntry(t, 1, t1, nil).Entry, Items: []map[string]interface{}{item("a"), item("b")}, LogIndex: 1},
+		},
+		{
+			desc:   "entry number same removal",
+			policy: "entry-number",
+			cur:    testEntry(t, 1, t1, item("a")),
+			e:      testEntry(t, 1, t1, nil),
+			want:   &records.Record{Entry: testEntry(t, 1, t1, nil).Entry, LogIndex: 1, Tombstone: true},
+		},
+		{
+			desc:   "entry number same add after removal",
+			policy: "entry-number",
+			cur:    testEntry(t, 1, t1, nil),
+			e:      testEntry(t, 1, t1, item("b")),
+			want:   &records.Record{Entry: testEntry(t, 1, t1, nil).Entry, Items: []map[string]interface{}{item("b")}, LogIndex: 1},
+		},
+		{
+			desc:   "keep all adds later item",
+			policy: "keep-all",
+			cur:    testEntry(t, 1, t1, item("a")),
+			e:      testEntry(t, 2, t2, item("b")),
+			want:   &records.Record{Entry: testEntry(t, 2, t2, nil).Entry, Items: []map[string]interface{}{item("a"), item("b")}, LogIndex: 2},
+		},
+		{
+			desc:   "keep all out of order keeps entry",
+			policy: "keep-all",
+			cur:    testEntry(t, 2, t2, item("b")),
+			e:      testEntry(t, 1, t1, item("a")),
+			want:   &records.Record{Entry: testEntry(t, 2, t2, nil).Entry, Items: []map[string]interface{}{item("b"), item("a")}, LogIndex: 2},
+		},
+		{
+			desc:   "keep all same second",
+			policy: "keep-all",
+			cur:    testEntry(t, 1, t1, item("a")),
+			e:      testEntry(t, 1, t1, item("b")),
+			want:   &records.Record{Entry: testEntry(t, 1, t1, nil).Entry, Items: []map[string]interface{}{item("a"), item("b")}, LogIndex: 1},
+		},
+		{
+			desc:   "keep all same number removal",
+			policy: "keep-all",
+			cur:    testEntry(t, 1, t1, item("a")),
+			e:      testEntry(t, 1, t1, nil),
+			want:   &records.Record{Entry: testEntry(t, 1, t1, nil).Entry, Items: []map[string]interface{}{item("a")}, LogIndex: 1, Tombstone: true},
+		},
+		{
+			desc:   "keep all out of order removal",
+			policy: "keep-all",
+			cur:    testEntry(t, 2, t2, item("b")),
+			e:      testEntry(t, 1, t1, nil),
+			want:   &records.Record{Entry: testEntry(t, 2, t2, nil).Entry, Items: []map[string]interface{}{item("b")}, LogIndex: 2},
+		},
+		{
+			desc:     "keep all later item revives without old items",
+			policy:   "keep-all",
+			cur:      testEntry(t, 2, t2, nil),
+			curItems: []map[string]interface{}{item("a")},
+			e:        testEntry(t, 3, t2, item("c")),
+			want:     &records.Record{Entry: testEntry(t, 3, t2, nil).Entry, Items: []map[string]interface{}{item("c")}, LogIndex: 3},
+		},
+		{
+			desc:   "keep all item before removal is skipped",
+			policy: "keep-all",
+			cur:    testEntry(t, 2, t2, nil),
+			e:      testEntry(t, 1, t1, item("a")),
+		},
+		{
+			desc:    "bad current timestamp",
+			policy:  "timestamp",
+			cur:     &entry{Entry: map[string]interface{}{"entry-timestamp": 7}},
+			e:       testEntry(t, 1, t1, item("a")),
+			wantErr: true,
+		},
+		{
+			desc:    "bad current entry number",
+			policy:  "entry-number",
+			cur:     &entry{Entry: map[string]interface{}{"entry-number": true}},
+			e:       testEntry(t, 1, t1, item("a")),
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			cr := newRecord(tc.cur)
+			cr.Items = append(cr.Items, tc.curItems...)
+			got, err := mergePolicies[tc.policy].Merge(cr, tc.e)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("Merge(): %v, want error %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Merge() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseEntry(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		value   string
+		wantErr bool
+	}{
+		{desc: "ok", value: `{"Entry":{"key":"k","entry-number":"1","entry-timestamp":"2018-01-01T00:00:00Z"},"Item":{"name":"a"}}`},
+		{desc: "removal", value: `{"Entry":{"key":"k","entry-number":1,"entry-timestamp":"2018-01-01T00:00:00Z"}}`},
+		{desc: "not json", value: `{`, wantErr: true},
+		{desc: "no entry", value: `{"Item":{}}`, wantErr: true},
+		{desc: "entry not an object", value: `{"Entry":"k"}`, wantErr: true},
+		{desc: "no key", value: `{"Entry":{"entry-number":1,"entry-timestamp":"2018-01-01T00:00:00Z"}}`, wantErr: true},
+		{desc: "bad timestamp", value: `{"Entry":{"key":"k","entry-number":1,"entry-timestamp":1}}`, wantErr: true},
+		{desc: "bad number", value: `{"Entry":{"key":"k","entry-number":"x","entry-timestamp":"2018-01-01T00:00:00Z"}}`, wantErr: true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			e, err := parseEntry(&trillian.LogLeaf{LeafIndex: 3, LeafValue: []byte(tc.value)})
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("parseEntry(): %v, want error %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if e.Key != "k" || e.Number != 1 || e.LogIndex != 3 {
+				t.Errorf("parseEntry() = %+v", e)
+			}
+		})
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 
 	"github.com/google/trillian"
@@ -15,6 +17,33 @@ const (
 	KTKey    = "key:"
 )
 
+// Record is the value stored at RecordHash(key) for each key in the
+// register. LogIndex is the index of the log leaf that Entry came from.
+// Tombstone is set when Entry removed the record.
+type Record struct {
+	Entry     map[string]interface{}
+	Items     []map[string]interface{}
+	LogIndex  int64
+	Tombstone bool `json:",omitempty"`
+}
+
+// Archived reports whether the record has been retired, either because
+// it was removed or because all of its items have an end-date.
+func (r *Record) Archived() bool {
+	if r.Tombstone {
+		return true
+	}
+	if len(r.Items) == 0 {
+		return false
+	}
+	for _, i := range r.Items {
+		if d, _ := i["end-date"].(string); d == "" {
+			return false
+		}
+	}
+	return true
+}
+
 func hash(kt string, key string) []byte {
 	hash := sha256.Sum256([]byte(kt + key))
 	return hash[:]
@@ -28,20 +57,98 @@ func KeyHash(index int) []byte {
 	return hash(KTKey, string(index))
 }
 
-func GetValue(tmc trillian.TrillianMapClient, id int64, hash []byte) *string {
-	index := [1][]byte{hash}
+// GetLeaf fetches the leaf at hash, along with its inclusion proof and
+// the map root the proof is relative to.
+func GetLeaf(tmc trillian.TrillianMapClient, id int64, hash []byte) (*trillian.MapLeafInclusion, *trillian.SignedMapRoot, error) {
+	incs, smr, err := GetLeaves(tmc, id, [][]byte{hash})
+	if err != nil {
+		return nil, nil, err
+	}
+	return incs[0], smr, nil
+}
+
+// GetLeafByRevision is like GetLeaf, but fetches the leaf as it was at
+// the given map revision.
+func GetLeafByRevision(tmc trillian.TrillianMapClient, id int64, rev int64, hash []byte) (*trillian.MapLeafInclusion, *trillian.SignedMapRoot, error) {
+	incs, smr, err := GetLeavesByRevision(tmc, id, rev, [][]byte{hash})
+	if err != nil {
+		return nil, nil, err
+	}
+	return incs[0], smr, nil
+}
+
+// GetLeaves fetches the leaves at hashes in a single request, so that
+// they are all from the same map revision. The inclusions are in the
+// same order as hashes.
+func GetLeaves(tmc trillian.TrillianMapClient, id int64, hashes [][]byte) ([]*trillian.MapLeafInclusion, *trillian.SignedMapRoot, error) {
 	req := &trillian.GetMapLeavesRequest{
 		MapId: id,
-		Index: index[:],
+		Index: hashes,
 	}
 
 	resp, err := tmc.GetLeaves(context.Background(), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	incs, err := byIndex(hashes, resp.MapLeafInclusion)
+	if err != nil {
+		return nil, nil, err
+	}
+	return incs, resp.MapRoot, nil
+}
+
+// GetLeavesByRevision is like GetLeaves, but fetches the leaves as they
+// were at the given map revision.
+func GetLeavesByRevision(tmc trillian.TrillianMapClient, id int64, rev int64, hashes [][]byte) ([]*trillian.MapLeafInclusion, *trillian.SignedMapRoot, error) {
+	req := &trillian.GetMapLeavesByRevisionRequest{
+		MapId:    id,
+		Index:    hashes,
+		Revision: rev,
+	}
+
+	resp, err := tmc.GetLeavesByRevision(context.Background(), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	incs, err := byIndex(hashes, resp.MapLeafInclusion)
+	if err != nil {
+		return nil, nil, err
+	}
+	return incs, resp.MapRoot, nil
+}
+
+// byIndex puts incs in the order of hashes, which the map doesn't
+// promise to keep, and checks that there is one for each hash.
+func byIndex(hashes [][]byte, incs []*trillian.MapLeafInclusion) ([]*trillian.MapLeafInclusion, error) {
+	if got, want := len(incs), len(hashes); got != want {
+		return nil, fmt.Errorf("got %d leaves, expected %d", got, want)
+	}
+	m := make(map[string]*trillian.MapLeafInclusion)
+	for _, inc := range incs {
+		if inc.Leaf == nil {
+			return nil, errors.New("got leaf inclusion without a leaf")
+		}
+		m[string(inc.Leaf.Index)] = inc
+	}
+	r := make([]*trillian.MapLeafInclusion, len(hashes))
+	for i, h := range hashes {
+		inc, ok := m[string(h)]
+		if !ok {
+			return nil, fmt.Errorf("no leaf for index %x", h)
+		}
+		r[i] = inc
+	}
+	return r, nil
+}
+
+func GetValue(tmc trillian.TrillianMapClient, id int64, hash []byte) *string {
+	inc, _, err := GetLeaf(tmc, id, hash)
 	if err != nil {
 		log.Fatalf("Can't get leaf '%s': %v", hex.EncodeToString(hash), err)
 	}
-	if resp.MapLeafInclusion[0].Leaf.LeafValue == nil {
+	if inc.Leaf.LeafValue == nil {
 		return nil
 	}
-	s := string(resp.MapLeafInclusion[0].Leaf.LeafValue)
+	s := string(inc.Leaf.LeafValue)
 	return &s
 }
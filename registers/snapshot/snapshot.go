@@ -0,0 +1,210 @@
+// Package snapshot writes and verifies point-in-time exports of a
+// register map. A snapshot is a directory holding every record at a
+// single map revision, the signed map root for that revision, and a
+// manifest of inclusion proofs tying each record to that root.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/registers/records"
+	tcrypto "github.com/google/trillian/crypto"
+	"github.com/google/trillian/merkle"
+	"github.com/google/trillian/merkle/maphasher"
+	"github.com/google/trillian/types"
+)
+
+// Files that make up a snapshot.
+const (
+	RecordsFile  = "records.jsonl"
+	MapRootFile  = "map-root.json"
+	ManifestFile = "manifest.json"
+)
+
+// Leaf is a map leaf in a snapshot, along with its inclusion proof.
+type Leaf struct {
+	Index     []byte
+	Value     []byte `json:",omitempty"`
+	Inclusion [][]byte
+}
+
+// Manifest describes the contents of a snapshot. Keys holds the key:n
+// leaves in order, and Records the corresponding record leaves, whose
+// values are the lines of the records file. End is the first key:n leaf
+// that is not set, whose proof of non-inclusion shows that no records
+// have been left out.
+type Manifest struct {
+	MapID    int64
+	Revision int64
+	Keys     []Leaf
+	Records  []Leaf
+	End      Leaf
+}
+
+// Write exports the map mapID at revision rev into dir, which is created
+// if necessary. A negative rev means the latest revision.
+func Write(tmc trillian.TrillianMapClient, mapID int64, rev int64, dir string) (*Manifest, error) {
+	if rev < 0 {
+		resp, err := tmc.GetSignedMapRoot(context.Background(), &trillian.GetSignedMapRootRequest{MapId: mapID})
+		if err != nil {
+			return nil, fmt.Errorf("can't get latest map root: %v", err)
+		}
+		var root types.MapRootV1
+		if err := root.UnmarshalBinary(resp.MapRoot.MapRoot); err != nil {
+			return nil, err
+		}
+		rev = int64(root.Revision)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	rf, err := os.Create(filepath.Join(dir, RecordsFile))
+	if err != nil {
+		return nil, err
+	}
+	defer rf.Close()
+	w := bufio.NewWriter(rf)
+
+	m := &Manifest{MapID: mapID, Revision: rev}
+	var smr *trillian.SignedMapRoot
+	for n := 0; ; n++ {
+		k, r, err := records.GetLeafByRevision(tmc, mapID, rev, records.KeyHash(n))
+		if err != nil {
+			return nil, fmt.Errorf("can't get key %d: %v", n, err)
+		}
+		if smr == nil {
+			smr = r
+		}
+		if k.Leaf.LeafValue == nil {
+			m.End = Leaf{Index: k.Leaf.Index, Inclusion: k.Inclusion}
+			break
+		}
+		m.Keys = append(m.Keys, Leaf{Index: k.Leaf.Index, Value: k.Leaf.LeafValue, Inclusion: k.Inclusion})
+
+		l, _, err := records.GetLeafByRevision(tmc, mapID, rev, records.RecordHash(string(k.Leaf.LeafValue)))
+		if err != nil {
+			return nil, fmt.Errorf("can't get record %q: %v", k.Leaf.LeafValue, err)
+		}
+		if bytes.IndexByte(l.Leaf.LeafValue, '\n') >= 0 {
+			return nil, fmt.Errorf("record %q contains a newline", k.Leaf.LeafValue)
+		}
+		m.Records = append(m.Records, Leaf{Index: l.Leaf.Index, Inclusion: l.Inclusion})
+		if _, err := w.Write(l.Leaf.LeafValue); err != nil {
+			return nil, fmt.Errorf("can't write record %q: %v", k.Leaf.LeafValue, err)
+		}
+		if err := w.WriteByte('\n'); err != nil {
+			return nil, fmt.Errorf("can't write record %q: %v", k.Leaf.LeafValue, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := rf.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := writeJSON(filepath.Join(dir, MapRootFile), smr); err != nil {
+		return nil, err
+	}
+	if err := writeJSON(filepath.Join(dir, ManifestFile), m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, j, 0644)
+}
+
+func readJSON(path string, v interface{}) error {
+	j, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+func verifyLeaf(mapID int64, root []byte, l Leaf, index []byte, value []byte) error {
+	if !bytes.Equal(l.Index, index) {
+		return fmt.Errorf("index is %x, expected %x", l.Index, index)
+	}
+	return merkle.VerifyMapInclusionProof(mapID, index, value, root, l.Inclusion, maphasher.Default)
+}
+
+// Verify checks the snapshot in dir without reference to Trillian. If
+// pubKey is nil the signature on the map root is not checked. It
+// returns the manifest of the verified snapshot.
+func Verify(dir string, pubKey crypto.PublicKey) (*Manifest, error) {
+	var smr trillian.SignedMapRoot
+	if err := readJSON(filepath.Join(dir, MapRootFile), &smr); err != nil {
+		return nil, fmt.Errorf("can't read map root: %v", err)
+	}
+	var m Manifest
+	if err := readJSON(filepath.Join(dir, ManifestFile), &m); err != nil {
+		return nil, fmt.Errorf("can't read manifest: %v", err)
+	}
+
+	root := &types.MapRootV1{}
+	if pubKey != nil {
+		var err error
+		if root, err = tcrypto.VerifySignedMapRoot(pubKey, crypto.SHA256, &smr); err != nil {
+			return nil, fmt.Errorf("bad map root signature: %v", err)
+		}
+	} else if err := root.UnmarshalBinary(smr.MapRoot); err != nil {
+		return nil, fmt.Errorf("can't unmarshal map root: %v", err)
+	}
+	if int64(root.Revision) != m.Revision {
+		return nil, fmt.Errorf("map root is at revision %d, manifest says %d", root.Revision, m.Revision)
+	}
+	if len(m.Keys) != len(m.Records) {
+		return nil, fmt.Errorf("manifest has %d keys but %d records", len(m.Keys), len(m.Records))
+	}
+
+	for n, k := range m.Keys {
+		if err := verifyLeaf(m.MapID, root.RootHash, k, records.KeyHash(n), k.Value); err != nil {
+			return nil, fmt.Errorf("key %d: %v", n, err)
+		}
+	}
+	if err := verifyLeaf(m.MapID, root.RootHash, m.End, records.KeyHash(len(m.Keys)), nil); err != nil {
+		return nil, fmt.Errorf("key %d is present, snapshot is incomplete: %v", len(m.Keys), err)
+	}
+
+	rf, err := os.Open(filepath.Join(dir, RecordsFile))
+	if err != nil {
+		return nil, err
+	}
+	defer rf.Close()
+	s := bufio.NewScanner(rf)
+	s.Buffer(nil, 16*1024*1024)
+	n := 0
+	for ; s.Scan(); n++ {
+		if n >= len(m.Records) {
+			return nil, fmt.Errorf("more records than the manifest lists")
+		}
+		k := string(m.Keys[n].Value)
+		if err := verifyLeaf(m.MapID, root.RootHash, m.Records[n], records.RecordHash(k), s.Bytes()); err != nil {
+			return nil, fmt.Errorf("record %q: %v", k, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if n != len(m.Records) {
+		return nil, fmt.Errorf("got %d records, manifest lists %d", n, len(m.Records))
+	}
+	return &m, nil
+}
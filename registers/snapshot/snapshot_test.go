@@ -0,0 +1,212 @@
+package snapshot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/registers/records"
+	"github.com/google/trillian/merkle/maphasher"
+	"github.com/google/trillian/types"
+)
+
+const testMapID = 5
+
+// bit returns bit b of index, counting from the right.
+func bit(index []byte, b int) int {
+	return int(index[len(index)-1-b/8]>>uint(b%8)) & 1
+}
+
+// subtreeHash returns the hash of the subtree of the given height
+// holding leaves, which are leaf hashes by index.
+func subtreeHash(height int, leaves map[string][]byte) []byte {
+	h := maphasher.Default
+	if len(leaves) == 0 {
+		return h.HashEmpty(testMapID, nil, height)
+	}
+	if height == 0 {
+		for _, lh := range leaves {
+			return lh
+		}
+	}
+	left := make(map[string][]byte)
+	right := make(map[string][]byte)
+	for i, lh := range leaves {
+		if bit([]byte(i), height-1) == 0 {
+			left[i] = lh
+		} else {
+			right[i] = lh
+		}
+	}
+	return h.HashChildren(subtreeHash(height-1, left), subtreeHash(height-1, right))
+}
+
+// testMap is an in-memory sparse Merkle map.
+type testMap map[string][]byte
+
+func (m testMap) leafHashes(t *testing.T) map[string][]byte {
+	t.Helper()
+	hashes := make(map[string][]byte)
+	for i, v := range m {
+		lh, err := maphasher.Default.HashLeaf(testMapID, []byte(i), v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[i] = lh
+	}
+	return hashes
+}
+
+func (m testMap) root(t *testing.T) []byte {
+	return subtreeHash(maphasher.Default.BitLen(), m.leafHashes(t))
+}
+
+// leaf returns the leaf at index with its inclusion proof.
+func (m testMap) leaf(t *testing.T, index []byte) Leaf {
+	hashes := m.leafHashes(t)
+	proof := make([][]byte, maphasher.Default.BitLen())
+	for height := range proof {
+		// The sibling at each height shares the bits above it with index.
+		sibling := make(map[string][]byte)
+		for i, lh := range hashes {
+			same := true
+			for b := height + 1; b < len(proof) && same; b++ {
+				same = bit([]byte(i), b) == bit(index, b)
+			}
+			if same && bit([]byte(i), height) != bit(index, height) {
+				sibling[i] = lh
+			}
+		}
+		if len(sibling) > 0 {
+			proof[height] = subtreeHash(height, sibling)
+		}
+	}
+	return Leaf{Index: index, Value: m[string(index)], Inclusion: proof}
+}
+
+// writeSnapshot writes a snapshot of m, which holds the given records,
+// into dir, as Write would.
+func writeSnapshot(t *testing.T, dir string, m testMap, recs []string) {
+	t.Helper()
+	root, err := (&types.MapRootV1{RootHash: m.root(t), Revision: 3}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJSON(filepath.Join(dir, MapRootFile), &trillian.SignedMapRoot{MapRoot: root}); err != nil {
+		t.Fatal(err)
+	}
+
+	man := &Manifest{MapID: testMapID, Revision: 3}
+	var lines []string
+	for n := range recs {
+		k := m.leaf(t, records.KeyHash(n))
+		if k.Value == nil {
+			t.Fatalf("key %d isn't in the map", n)
+		}
+		man.Keys = append(man.Keys, k)
+		r := m.leaf(t, records.RecordHash(string(k.Value)))
+		lines = append(lines, string(r.Value))
+		r.Value = nil
+		man.Records = append(man.Records, r)
+	}
+	man.End = m.leaf(t, records.KeyHash(len(recs)))
+	if err := writeJSON(filepath.Join(dir, ManifestFile), man); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, RecordsFile), []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	keys := []string{"a", "b", "c"}
+	m := make(testMap)
+	var recs []string
+	for n, k := range keys {
+		m[string(records.KeyHash(n))] = []byte(k)
+		r := fmt.Sprintf(`{"Entry":{"key":%q}}`, k)
+		m[string(records.RecordHash(k))] = []byte(r)
+		recs = append(recs, r)
+	}
+
+	for _, tc := range []struct {
+		desc string
+		// change alters the snapshot in dir, which is valid to begin with.
+		change  func(t *testing.T, dir string)
+		wantErr bool
+	}{
+		{
+			desc:   "valid",
+			change: func(t *testing.T, dir string) {},
+		},
+		{
+			desc: "tampered record",
+			change: func(t *testing.T, dir string) {
+				tampered := append(append([]string{}, recs[:2]...), `{"Entry":{"key":"x"}}`)
+				if err := ioutil.WriteFile(filepath.Join(dir, RecordsFile), []byte(strings.Join(tampered, "\n")+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: true,
+		},
+		{
+			desc: "record missing from records file",
+			change: func(t *testing.T, dir string) {
+				if err := ioutil.WriteFile(filepath.Join(dir, RecordsFile), []byte(strings.Join(recs[:2], "\n")+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: true,
+		},
+		{
+			desc: "record missing from snapshot",
+			change: func(t *testing.T, dir string) {
+				writeSnapshot(t, dir, m, recs[:2])
+			},
+			wantErr: true,
+		},
+		{
+			desc: "forged end proof",
+			change: func(t *testing.T, dir string) {
+				writeSnapshot(t, dir, m, recs[:2])
+				var man Manifest
+				if err := readJSON(filepath.Join(dir, ManifestFile), &man); err != nil {
+					t.Fatal(err)
+				}
+				// Prove key 2 absent from a map without it.
+				without := make(testMap)
+				for i, v := range m {
+					without[i] = v
+				}
+				delete(without, string(records.KeyHash(2)))
+				man.End = without.leaf(t, records.KeyHash(2))
+				if err := writeJSON(filepath.Join(dir, ManifestFile), &man); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "snapshot_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			writeSnapshot(t, dir, m, recs)
+			tc.change(t, dir)
+
+			man, err := Verify(dir, nil)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("Verify(): %v, want error %v", err, tc.wantErr)
+			}
+			if err == nil && (len(man.Keys) != len(keys) || man.Revision != 3) {
+				t.Errorf("Verify() = %+v", man)
+			}
+		})
+	}
+}
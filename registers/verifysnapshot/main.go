@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/google/trillian-examples/registers/snapshot"
+	"github.com/google/trillian/crypto/keys/pem"
+)
+
+var (
+	dir          = flag.String("dir", "snapshot", "directory holding the snapshot to verify.")
+	mapPublicKey = flag.String("map_public_key", "", "PEM file holding the map's public key. If unset, the map root signature is not checked.")
+)
+
+func main() {
+	flag.Parse()
+
+	var pub crypto.PublicKey
+	if *mapPublicKey != "" {
+		var err error
+		if pub, err = pem.ReadPublicKeyFile(*mapPublicKey); err != nil {
+			log.Fatalf("Can't read public key: %v", err)
+		}
+	} else {
+		log.Printf("No --map_public_key, not checking map root signature")
+	}
+
+	m, err := snapshot.Verify(*dir, pub)
+	if err != nil {
+		log.Fatalf("Snapshot is NOT valid: %v", err)
+	}
+	fmt.Printf("Snapshot of map %d at revision %d is valid: %d records\n", m.MapID, m.Revision, len(m.Records))
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/google/trillian"
 	"github.com/google/trillian-examples/registers/records"
@@ -17,29 +19,226 @@ import (
 var (
 	trillianMap = flag.String("trillian_map", "localhost:8095", "address of the Trillian Map RPC server.")
 	mapID       = flag.Int64("map_id", 0, "Trillian MapID to read.")
+	linkedMaps  = flag.String("linked_maps", "", "comma-separated register=map_id pairs for other registers in the mirror, used by ?expand=.")
 )
 
 // FIXME: rather than use a global, make a closure around serveRecords
 var tmc trillian.TrillianMapClient
 
-func fixRecord(j string) ([]byte, string) {
+// registerMaps maps register names to the MapID holding that register.
+var registerMaps = make(map[string]int64)
+
+// link is a record from another register, embedded in place of the
+// key that referred to it. It carries its own inclusion proof and map
+// root so that it can be verified independently of the record that
+// linked to it.
+type link struct {
+	Register string                     `json:"register"`
+	Key      string                     `json:"key"`
+	Record   map[string]interface{}     `json:"record"`
+	Proof    *trillian.MapLeafInclusion `json:"proof"`
+	MapRoot  *trillian.SignedMapRoot    `json:"map-root"`
+}
+
+func parseLinkedMaps(s string) error {
+	if s == "" {
+		return nil
+	}
+	for _, p := range strings.Split(s, ",") {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("bad linked map %q, want register=map_id", p)
+		}
+		id, err := strconv.ParseInt(kv[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad map ID for register %q: %v", kv[0], err)
+		}
+		registerMaps[kv[0]] = id
+	}
+	return nil
+}
+
+// linkTarget returns the register and key that the value v of field
+// refers to. A CURIE such as "local-authority-type:MD" names its
+// register explicitly, otherwise the field name is taken to be the
+// register name, as is the convention for foreign keys in registers.
+func linkTarget(field string, v string) (string, string) {
+	if i := strings.Index(v, ":"); i > 0 {
+		if _, ok := registerMaps[v[:i]]; ok {
+			return v[:i], v[i+1:]
+		}
+	}
+	return field, v
+}
+
+// linkRef is a value in a record that links to a record in a register
+// in the mirror. set replaces the value with the record it links to.
+type linkRef struct {
+	register string
+	key      string
+	set      func(*link)
+}
+
+// findLinks returns the values of the given fields in each item of f
+// that link to a register in the mirror.
+func findLinks(f map[string]interface{}, fields []string) []linkRef {
+	var refs []linkRef
+	add := func(field string, v string, set func(*link)) {
+		reg, key := linkTarget(field, v)
+		if _, ok := registerMaps[reg]; !ok {
+			log.Printf("Can't expand %s=%s: no map for register %q", field, v, reg)
+			return
+		}
+		refs = append(refs, linkRef{register: reg, key: key, set: set})
+	}
+
+	items, ok := f["item"].([]interface{})
+	if !ok {
+		return nil
+	}
+	for _, ii := range items {
+		i, ok := ii.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, field := range fields {
+			field := field
+			switch v := i[field].(type) {
+			case string:
+				add(field, v, func(l *link) { i[field] = l })
+			case []interface{}:
+				for n, vv := range v {
+					s, ok := vv.(string)
+					if !ok {
+						continue
+					}
+					n := n
+					add(field, s, func(l *link) { v[n] = l })
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// fetched is a leaf fetched while expanding a record, with the root of
+// the map it came from.
+type fetched struct {
+	inc *trillian.MapLeafInclusion
+	smr *trillian.SignedMapRoot
+}
+
+// expandRecord returns the record with the given key, in which the
+// values of the given fields in each item have been replaced with the
+// records they link to. The record and the links into this register are
+// fetched in a single request, as are the links into each other
+// register, so that everything returned from a register is at the same
+// revision and can be checked against the one map root. The record
+// carries its own inclusion proof and map root. Values that can't be
+// resolved are left as they are.
+func expandRecord(key string, f map[string]interface{}, fields []string) (map[string]interface{}, error) {
+	top := records.RecordHash(key)
+	hashes := map[int64][][]byte{*mapID: {top}}
+	seen := map[int64]map[string]bool{*mapID: {string(top): true}}
+	for _, r := range findLinks(f, fields) {
+		id := registerMaps[r.register]
+		h := records.RecordHash(r.key)
+		if seen[id] == nil {
+			seen[id] = make(map[string]bool)
+		}
+		if !seen[id][string(h)] {
+			seen[id][string(h)] = true
+			hashes[id] = append(hashes[id], h)
+		}
+	}
+
+	leaves := make(map[int64]map[string]fetched)
+	for id, hs := range hashes {
+		incs, smr, err := records.GetLeaves(tmc, id, hs)
+		if err != nil {
+			return nil, fmt.Errorf("can't get %d records from map %d: %v", len(hs), id, err)
+		}
+		leaves[id] = make(map[string]fetched)
+		for _, inc := range incs {
+			leaves[id][string(inc.Leaf.Index)] = fetched{inc: inc, smr: smr}
+		}
+	}
+
+	// The record may have changed since f was read, so the links are
+	// taken from the copy fetched along with them.
+	t := leaves[*mapID][string(top)]
+	if t.inc.Leaf.LeafValue == nil {
+		return nil, fmt.Errorf("record %q has gone", key)
+	}
+	f, _, err := fixRecord(string(t.inc.Leaf.LeafValue))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range findLinks(f, fields) {
+		l, ok := leaves[registerMaps[r.register]][string(records.RecordHash(r.key))]
+		if !ok {
+			log.Printf("Can't expand link to %s:%s: record changed while expanding", r.register, r.key)
+			continue
+		}
+		if l.inc.Leaf.LeafValue == nil {
+			log.Printf("Can't expand link to %s:%s: no such record", r.register, r.key)
+			continue
+		}
+		lr, _, err := fixRecord(string(l.inc.Leaf.LeafValue))
+		if err != nil {
+			log.Printf("Can't expand link to %s:%s: %v", r.register, r.key, err)
+			continue
+		}
+		r.set(&link{Register: r.register, Key: r.key, Record: lr, Proof: l.inc, MapRoot: l.smr})
+	}
+	f["proof"] = t.inc
+	f["map-root"] = t.smr
+	return f, nil
+}
+
+// Values of ?status=, as in the registers API.
+const (
+	statusCurrent  = "current"
+	statusArchived = "archived"
+	statusAll      = "all"
+)
+
+// hasStatus reports whether the record j matches status.
+func hasStatus(j string, status string) bool {
+	if status == statusAll {
+		return true
+	}
+	var r records.Record
+	if err := json.Unmarshal([]byte(j), &r); err != nil {
+		log.Printf("Can't unmarshal record: %v", err)
+		return false
+	}
+	return r.Archived() == (status == statusArchived)
+}
+
+// fixRecord converts the record j, as stored in the map, to the form
+// the registers API returns, along with its key.
+func fixRecord(j string) (map[string]interface{}, string, error) {
 	var v map[string]interface{}
-	json.Unmarshal([]byte(j), &v)
-	log.Printf("%v", v)
+	if err := json.Unmarshal([]byte(j), &v); err != nil {
+		return nil, "", fmt.Errorf("can't unmarshal record: %v", err)
+	}
 
 	f := make(map[string]interface{})
-	i := v["Entry"].(map[string]interface{})
+	i, ok := v["Entry"].(map[string]interface{})
+	if !ok {
+		return nil, "", fmt.Errorf("record has no entry: %.100s", j)
+	}
 	for _, s := range []string{"entry-number", "entry-timestamp", "index-entry-number", "key"} {
 		f[s] = i[s]
 	}
 	f["item"] = v["Items"]
 
-	jj, err := json.Marshal(f)
-	if err != nil {
-		log.Fatal(err)
+	k, ok := f["key"].(string)
+	if !ok {
+		return nil, "", fmt.Errorf("record has no key: %.100s", j)
 	}
-
-	return jj, f["key"].(string)
+	return f, k, nil
 }
 
 func serveRecords(w http.ResponseWriter, r *http.Request) {
@@ -67,28 +266,106 @@ func serveRecords(w http.ResponseWriter, r *http.Request) {
 		// Sigh. Start index is 1? Really?
 		start = (start - 1) * size
 	}
+	var expand []string
+	for _, e := range r.Form["expand"] {
+		expand = append(expand, strings.Split(e, ",")...)
+	}
+
+	status := statusAll
+	if st := r.Form["status"]; st != nil {
+		status = st[0]
+	}
+	if status != statusCurrent && status != statusArchived && status != statusAll {
+		http.Error(w, fmt.Sprintf("bad status %q", status), http.StatusBadRequest)
+		return
+	}
+
+	// Without a filter we can go straight to the first key on the page,
+	// otherwise we have to skip over the matching records before it,
+	// unless the client gives the key to resume from with ?page-start=,
+	// as in the next link of the previous page.
+	n, skip := start, 0
+	if status != statusAll {
+		n, skip = 0, start
+	}
+	if ps := r.Form["page-start"]; ps != nil {
+		n, err = strconv.Atoi(ps[0])
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("bad page-start %q", ps[0]), http.StatusBadRequest)
+			return
+		}
+		skip = 0
+	}
 
-	io.WriteString(w, "{")
-	for n := start; n < start+size; n++ {
+	// The page is built before it is sent so that the next link, which
+	// depends on how far we got, can go in the headers.
+	var b bytes.Buffer
+	b.WriteString("{")
+	written := 0
+	for ; written < size; n++ {
 		resp := records.GetValue(tmc, *mapID, records.KeyHash(n))
 		if resp == nil {
 			break
 		}
-		resp = records.GetValue(tmc, *mapID, records.RecordHash(*resp))
+		key := *resp
+		resp = records.GetValue(tmc, *mapID, records.RecordHash(key))
+		if resp == nil {
+			http.Error(w, fmt.Sprintf("no record for key %q", key), http.StatusInternalServerError)
+			return
+		}
+		if !hasStatus(*resp, status) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
 		// FIXME: not formatted exactly like GDS registers...
 		//fmt.Fprintf(w, "%s\n", *resp)
-		r, k := fixRecord(*resp)
-		if n != start {
-			io.WriteString(w, ",")
+		f, k, err := fixRecord(*resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		fmt.Fprintf(w, "\"%s\":%s", k, r)
+		if len(expand) != 0 {
+			// A record that can't be expanded is sent as it is.
+			if e, err := expandRecord(k, f, expand); err != nil {
+				log.Printf("Can't expand record %q: %v", k, err)
+			} else {
+				f = e
+			}
+		}
+		r, err := json.Marshal(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if written != 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "\"%s\":%s", k, r)
+		written++
+	}
+	b.WriteString("}")
+
+	if written == size {
+		next := url.Values{}
+		for k, v := range r.Form {
+			next[k] = v
+		}
+		next.Del("page-index")
+		next.Set("page-start", strconv.Itoa(n))
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, next.Encode()))
 	}
-	io.WriteString(w, "}")
+	b.WriteTo(w)
 }
 
 func main() {
 	flag.Parse()
 
+	if err := parseLinkedMaps(*linkedMaps); err != nil {
+		log.Fatal(err)
+	}
+
 	g, err := grpc.Dial(*trillianMap, grpc.WithInsecure())
 	if err != nil {
 		log.Fatalf("Failed to dial Trillian Log: %v", err)